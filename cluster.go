@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	kafka "github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/segmentio/kafka-go/sasl/scram"
+)
+
+const dialTimeout = 10 * time.Second
+
+// cluster is a set of parameters to connect to kafka brokers. The same
+// parameters are used by readers, consumer groups and direct connections.
+type cluster struct {
+	brokers []string
+	dialer  *kafka.Dialer
+}
+
+// newCluster creates connection parameters with optional TLS and SASL.
+func newCluster(conf KafkaConf) (*cluster, error) {
+	dialer := &kafka.Dialer{
+		Timeout:   dialTimeout,
+		DualStack: true,
+	}
+	if conf.TLS != nil {
+		tlsConf, err := newTLSConfig(*conf.TLS)
+		if err != nil {
+			return nil, fmt.Errorf("init tls: %v", err)
+		}
+		dialer.TLS = tlsConf
+	}
+	if conf.SASL != nil {
+		mech, err := newSASLMechanism(*conf.SASL)
+		if err != nil {
+			return nil, fmt.Errorf("init sasl: %v", err)
+		}
+		dialer.SASLMechanism = mech
+	}
+	return &cluster{brokers: conf.Brokers, dialer: dialer}, nil
+}
+
+// dial connects to the first broker.
+func (c *cluster) dial(ctx context.Context) (*kafka.Conn, error) {
+	return c.dialer.DialContext(ctx, "tcp", c.brokers[0])
+}
+
+// dialLeader connects to the leader of the partition.
+func (c *cluster) dialLeader(ctx context.Context, p kafka.Partition) (*kafka.Conn, error) {
+	addr := fmt.Sprintf("%s:%d", p.Leader.Host, p.Leader.Port)
+	return c.dialer.DialLeader(ctx, "tcp", addr, p.Topic, p.ID)
+}
+
+// transport creates a transport for consumer groups.
+func (c *cluster) transport() *kafka.Transport {
+	return &kafka.Transport{
+		DialTimeout: c.dialer.Timeout,
+		TLS:         c.dialer.TLS,
+		SASL:        c.dialer.SASLMechanism,
+	}
+}
+
+func newTLSConfig(conf TLSConf) (*tls.Config, error) {
+	tlsConf := &tls.Config{
+		InsecureSkipVerify: conf.InsecureSkipVerify, // nolint: gosec
+		MinVersion:         tls.VersionTLS12,
+	}
+	if conf.CA != "" {
+		ca, err := ioutil.ReadFile(conf.CA)
+		if err != nil {
+			return nil, fmt.Errorf("read ca file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in %s", conf.CA)
+		}
+		tlsConf.RootCAs = pool
+	}
+	if conf.Cert != "" || conf.Key != "" {
+		cert, err := tls.LoadX509KeyPair(conf.Cert, conf.Key)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %v", err)
+		}
+		tlsConf.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConf, nil
+}
+
+func newSASLMechanism(conf SASLConf) (sasl.Mechanism, error) {
+	switch strings.ToLower(conf.Mechanism) {
+	case "plain":
+		return plain.Mechanism{Username: conf.Username, Password: conf.Password}, nil
+	case "scram-sha-256":
+		return scram.Mechanism(scram.SHA256, conf.Username, conf.Password)
+	case "scram-sha-512":
+		return scram.Mechanism(scram.SHA512, conf.Username, conf.Password)
+	default:
+		return nil, fmt.Errorf("unknown mechanism: %s", conf.Mechanism)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestNewCluster(t *testing.T) {
+	testCases := []struct {
+		name string
+		conf KafkaConf
+		tls  bool
+		sasl string
+		err  bool
+	}{
+		{
+			name: "plain connection",
+			conf: KafkaConf{Brokers: []string{"localhost:9092"}},
+		},
+		{
+			name: "tls with system certificates",
+			conf: KafkaConf{
+				Brokers: []string{"localhost:9092"},
+				TLS:     &TLSConf{},
+			},
+			tls: true,
+		},
+		{
+			name: "sasl plain",
+			conf: KafkaConf{
+				Brokers: []string{"localhost:9092"},
+				SASL:    &SASLConf{Mechanism: "plain", Username: "user", Password: "pass"},
+			},
+			sasl: "PLAIN",
+		},
+		{
+			name: "sasl scram",
+			conf: KafkaConf{
+				Brokers: []string{"localhost:9092"},
+				SASL:    &SASLConf{Mechanism: "SCRAM-SHA-512", Username: "user", Password: "pass"},
+			},
+			sasl: "SCRAM-SHA-512",
+		},
+		{
+			name: "unknown sasl mechanism",
+			conf: KafkaConf{
+				Brokers: []string{"localhost:9092"},
+				SASL:    &SASLConf{Mechanism: "gssapi"},
+			},
+			err: true,
+		},
+		{
+			name: "missing ca file",
+			conf: KafkaConf{
+				Brokers: []string{"localhost:9092"},
+				TLS:     &TLSConf{CA: "/not/exists/ca.pem"},
+			},
+			err: true,
+		},
+		{
+			name: "missing client key",
+			conf: KafkaConf{
+				Brokers: []string{"localhost:9092"},
+				TLS:     &TLSConf{Cert: "/not/exists/client.pem"},
+			},
+			err: true,
+		},
+	}
+
+	for _, tt := range testCases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			cl, err := newCluster(tt.conf)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("Expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if (cl.dialer.TLS != nil) != tt.tls {
+				t.Fatalf("Expected tls %v, got %v", tt.tls, cl.dialer.TLS != nil)
+			}
+			var sasl string
+			if cl.dialer.SASLMechanism != nil {
+				sasl = cl.dialer.SASLMechanism.Name()
+			}
+			if sasl != tt.sasl {
+				t.Fatalf("Expected sasl %q, got %q", tt.sasl, sasl)
+			}
+		})
+	}
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"fmt"
 	"io/ioutil"
+	"runtime"
+	"strings"
 	"time"
 
 	"gopkg.in/yaml.v3"
@@ -15,11 +17,96 @@ const (
 
 // Config is a main app configuration.
 type Config struct {
-	File   string                 `yaml:"file"`
-	Mongo  MongoConf              `yaml:"mongo"`
-	Kafka  KafkaConf              `yaml:"kafka"`
-	Filter map[string]interface{} `yaml:"filter"`
-	Logs   LogsConf               `yaml:"logs"`
+	File           FileConf               `yaml:"file"`
+	CSV            CSVConf                `yaml:"csv"`
+	Parquet        ParquetConf            `yaml:"parquet"`
+	Mongo          MongoConf              `yaml:"mongo"`
+	Kafka          KafkaConf              `yaml:"kafka"`
+	PayloadFormat  string                 `yaml:"payload_format"`
+	SchemaRegistry SchemaRegistryConf     `yaml:"schema_registry"`
+	Protobuf       ProtobufConf           `yaml:"protobuf"`
+	Filter         map[string]interface{} `yaml:"filter"`
+	FilterExpr     string                 `yaml:"filter_expr"`
+	Invalid        InvalidConf            `yaml:"invalid"`
+	Workers        int                    `yaml:"workers"`
+	Limits         Limits                 `yaml:"limits"`
+	Logs           LogsConf               `yaml:"logs"`
+}
+
+// SchemaRegistryConf is a set of parameters of a Confluent-compatible
+// schema registry.
+type SchemaRegistryConf struct {
+	URL      string `yaml:"url"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+// ProtobufConf is a set of parameters of protobuf payload: a path to
+// a compiled FileDescriptorSet and a fully-qualified message name.
+type ProtobufConf struct {
+	DescriptorSet string `yaml:"descriptor_set"`
+	Message       string `yaml:"message"`
+}
+
+// FileConf is a set of file storage parameters. It is set either as
+// a path to the file, or as an object with parameters.
+type FileConf struct {
+	Path string `yaml:"path"`
+	// Format is either pretty (default) or jsonl.
+	Format string `yaml:"format"`
+	// Envelope enables wrapping messages into objects with kafka attributes.
+	Envelope bool `yaml:"envelope"`
+	// Raw enables writing original payloads instead of decoded ones.
+	Raw bool `yaml:"raw"`
+	// Append enables appending to existing files instead of truncating them.
+	Append bool `yaml:"append"`
+	// Rotation limits, zero values mean no limit. Rotation requires {seq}
+	// placeholder in the path.
+	MaxBytes   int64         `yaml:"max_bytes"`
+	MaxRecords int           `yaml:"max_records"`
+	Interval   time.Duration `yaml:"interval"`
+	// MaxFiles is a number of retained files, older files are removed.
+	MaxFiles int `yaml:"max_files"`
+	// Compression is either gzip or zstd, with optional level: 1-9 for gzip,
+	// 1-22 for zstd.
+	Compression      string `yaml:"compression"`
+	CompressionLevel int    `yaml:"compression_level"`
+}
+
+// UnmarshalYAML parses file storage parameters from yaml.
+func (f *FileConf) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		return value.Decode(&f.Path)
+	}
+	type plain FileConf
+	return value.Decode((*plain)(f))
+}
+
+// CSVConf is a set of CSV storage parameters. Columns are field paths
+// or kafka message attributes, e.g. $time, $partition or $key.
+type CSVConf struct {
+	Path      string   `yaml:"path"`
+	Columns   []string `yaml:"columns"`
+	Delimiter string   `yaml:"delimiter"`
+	NoHeader  bool     `yaml:"no_header"`
+}
+
+// ParquetConf is a set of parquet storage parameters. When columns are
+// not set, the schema is inferred from the first messages.
+type ParquetConf struct {
+	Path         string          `yaml:"path"`
+	Columns      []ParquetColumn `yaml:"columns"`
+	InferRows    int             `yaml:"infer_rows"`
+	RowGroupSize int64           `yaml:"row_group_size"`
+}
+
+// ParquetColumn is a column of parquet schema. Field is a field path
+// or a kafka message attribute, the column name by default. Type is one
+// of string, int, float, bool, time or json.
+type ParquetColumn struct {
+	Name  string `yaml:"name"`
+	Field string `yaml:"field"`
+	Type  string `yaml:"type"`
 }
 
 // MongoConf is a set of mongodb parameters.
@@ -31,10 +118,46 @@ type MongoConf struct {
 
 // KafkaConf is a set of kafka parameters.
 type KafkaConf struct {
-	Brokers []string `yaml:"brokers"`
-	Topic   string   `yaml:"topic"`
-	Offset  int64    `yaml:"offset"`
-	GroupID string   `yaml:"group_id"`
+	Brokers    []string  `yaml:"brokers"`
+	Topic      string    `yaml:"topic"`
+	Topics     []string  `yaml:"topics"`
+	TopicRegex string    `yaml:"topic_regex"`
+	Offset     Offset    `yaml:"offset"`
+	Until      Timestamp `yaml:"until"`
+	GroupID    string    `yaml:"group_id"`
+	TLS        *TLSConf  `yaml:"tls"`
+	SASL       *SASLConf `yaml:"sasl"`
+}
+
+// TLSConf is a set of TLS parameters for kafka connections.
+type TLSConf struct {
+	CA                 string `yaml:"ca"`
+	Cert               string `yaml:"cert"`
+	Key                string `yaml:"key"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+}
+
+// SASLConf is a set of SASL authentication parameters. Supported
+// mechanisms: plain, scram-sha-256, scram-sha-512.
+type SASLConf struct {
+	Mechanism string `yaml:"mechanism"`
+	Username  string `yaml:"username"`
+	Password  string `yaml:"password"`
+}
+
+// InvalidConf is a configuration of handling messages that cannot
+// be decoded, including tombstones. Policy is one of skip (default), fail,
+// or dead_letter, which writes messages to the dead letter file.
+type InvalidConf struct {
+	Policy     string `yaml:"policy"`
+	DeadLetter string `yaml:"dead_letter"`
+}
+
+// Limits is a set of conditions to stop the dump. Zero values mean
+// no limit.
+type Limits struct {
+	MaxMessages int `yaml:"max_messages"`
+	MaxSaved    int `yaml:"max_saved"`
 }
 
 // LogsConf is a logging configuration.
@@ -43,6 +166,88 @@ type LogsConf struct {
 	Period time.Duration `yaml:"period"`
 }
 
+// Timestamp is a point in time, set either as unix timestamp in seconds,
+// as RFC3339 string, or as negative duration relative to the current time,
+// e.g. -2h.
+type Timestamp struct {
+	time.Time
+}
+
+// UnmarshalYAML parses a timestamp from yaml.
+func (t *Timestamp) UnmarshalYAML(value *yaml.Node) error {
+	var sec int64
+	if err := value.Decode(&sec); err == nil {
+		t.Time = time.Unix(sec, 0)
+		return nil
+	}
+	var s string
+	if err := value.Decode(&s); err != nil {
+		return fmt.Errorf("invalid timestamp: %v", err)
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		if d >= 0 {
+			return fmt.Errorf("invalid timestamp: duration must be negative")
+		}
+		t.Time = time.Now().Add(d)
+		return nil
+	}
+	ts, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp: %v", err)
+	}
+	t.Time = ts
+	return nil
+}
+
+// Offset is a start position in a topic. It is set either as a special
+// value (-1 for newest messages, -2 for oldest messages), as a timestamp
+// (see Timestamp), or as a map of partitions to their offsets. Zero means
+// the default position.
+type Offset struct {
+	Position   int64
+	Time       time.Time
+	Partitions map[int]int64
+}
+
+// Start positions.
+const (
+	OffsetNewest int64 = -1
+	OffsetOldest int64 = -2
+)
+
+// UnmarshalYAML parses an offset from yaml.
+func (o *Offset) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.MappingNode {
+		if err := value.Decode(&o.Partitions); err != nil {
+			return fmt.Errorf("invalid partitions offsets: %v", err)
+		}
+		return nil
+	}
+	var pos int64
+	if err := value.Decode(&pos); err == nil {
+		switch {
+		case pos == 0:
+			return nil
+		case pos == OffsetNewest || pos == OffsetOldest:
+			o.Position = pos
+			return nil
+		case pos < 0:
+			return fmt.Errorf("invalid offset: %d", pos)
+		}
+	}
+	var ts Timestamp
+	if err := value.Decode(&ts); err != nil {
+		return err
+	}
+	o.Time = ts.Time
+	return nil
+}
+
+// IsZero tells whether the offset is not set.
+func (o Offset) IsZero() bool {
+	return o.Position == 0 && o.Time.IsZero() && o.Partitions == nil
+}
+
 // ReadConfig reads configuration from a file.
 func ReadConfig() (Config, error) {
 	f, err := ioutil.ReadFile(configFile)
@@ -53,12 +258,106 @@ func ReadConfig() (Config, error) {
 	if err := yaml.Unmarshal(f, &conf); err != nil {
 		return Config{}, fmt.Errorf("unmarshal yaml: %v", err)
 	}
-	if conf.File != "" && conf.Mongo.Addr != "" {
-		return Config{}, fmt.Errorf("only one storage should be specified: file or mongodb")
+	var storages int
+	for _, set := range []bool{
+		conf.File.Path != "",
+		conf.CSV.Path != "",
+		conf.Parquet.Path != "",
+		conf.Mongo.Addr != "",
+	} {
+		if set {
+			storages++
+		}
+	}
+	if storages > 1 {
+		return Config{}, fmt.Errorf("only one storage should be specified: file, csv, parquet or mongodb")
 	}
-	if conf.File == "" && conf.Mongo.Addr == "" {
+	if storages == 0 {
 		return Config{}, fmt.Errorf("no storage specified")
 	}
+	switch conf.File.Format {
+	case "", FileFormatPretty, FileFormatJSONL:
+	default:
+		return Config{}, fmt.Errorf("unknown file format: %s", conf.File.Format)
+	}
+	rotated := conf.File.MaxBytes > 0 || conf.File.MaxRecords > 0 || conf.File.Interval > 0
+	if rotated && !strings.Contains(conf.File.Path, placeholderSeq) {
+		return Config{}, fmt.Errorf("file rotation requires %s in the path", placeholderSeq)
+	}
+	switch conf.File.Compression {
+	case "":
+	case CompressionGzip:
+		if conf.File.CompressionLevel < 0 || conf.File.CompressionLevel > 9 {
+			return Config{}, fmt.Errorf("invalid gzip compression level: %d", conf.File.CompressionLevel)
+		}
+	case CompressionZstd:
+		if conf.File.CompressionLevel < 0 || conf.File.CompressionLevel > 22 {
+			return Config{}, fmt.Errorf("invalid zstd compression level: %d", conf.File.CompressionLevel)
+		}
+	default:
+		return Config{}, fmt.Errorf("unknown compression: %s", conf.File.Compression)
+	}
+	if conf.File.Raw && conf.File.Envelope {
+		return Config{}, fmt.Errorf("envelope cannot be used with raw payloads")
+	}
+	// Raw payloads are separated by newlines, so binary payloads
+	// cannot be saved this way
+	switch conf.PayloadFormat {
+	case "", FormatJSON, FormatJSONAny, FormatText:
+	default:
+		if conf.File.Raw {
+			return Config{}, fmt.Errorf("raw payloads cannot be saved for %s format", conf.PayloadFormat)
+		}
+	}
+	if conf.CSV.Path != "" {
+		if _, err := parseColumns(conf.CSV.Columns); err != nil {
+			return Config{}, fmt.Errorf("invalid csv columns: %v", err)
+		}
+		if _, err := parseDelimiter(conf.CSV.Delimiter); err != nil {
+			return Config{}, fmt.Errorf("invalid csv: %v", err)
+		}
+	}
+	// Partitions of a group are assigned to its members, so the dump
+	// cannot know when all of them have reached the end
+	if !conf.Kafka.Until.IsZero() && conf.Kafka.GroupID != "" {
+		return Config{}, fmt.Errorf("until cannot be used with consumer group")
+	}
+	// Parquet file is only readable after it's finalized, so offsets
+	// must not be committed before it
+	if conf.Parquet.Path != "" && conf.Kafka.GroupID != "" {
+		return Config{}, fmt.Errorf("parquet storage cannot be used with consumer group")
+	}
+	for _, col := range conf.Parquet.Columns {
+		if _, err := parquetNode(col.Type); err != nil {
+			return Config{}, fmt.Errorf("invalid parquet column %s: %v", col.Name, err)
+		}
+	}
+	if _, err := NewDecoder(conf); err != nil {
+		return Config{}, fmt.Errorf("invalid payload format: %v", err)
+	}
+	if _, err := NewFieldFilter(conf.Filter); err != nil {
+		return Config{}, fmt.Errorf("invalid filter: %v", err)
+	}
+	if conf.FilterExpr != "" {
+		if _, err := NewExprFilter(conf.FilterExpr); err != nil {
+			return Config{}, fmt.Errorf("invalid filter expression: %v", err)
+		}
+	}
+	switch conf.Invalid.Policy {
+	case "", InvalidSkip, InvalidFail:
+	case InvalidDeadLetter:
+		if conf.Invalid.DeadLetter == "" {
+			return Config{}, fmt.Errorf("no dead letter file specified")
+		}
+	default:
+		return Config{}, fmt.Errorf("unknown invalid messages policy: %s", conf.Invalid.Policy)
+	}
+	if conf.Workers < 0 {
+		return Config{}, fmt.Errorf("invalid number of workers: %d", conf.Workers)
+	}
+	if conf.Workers == 0 {
+		conf.Workers = runtime.NumCPU()
+	}
 	if conf.Logs.Period == 0 {
 		conf.Logs.Period = defaultLogPeriod
 	}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestTimestampUnmarshalYAML(t *testing.T) {
+	testCases := []struct {
+		name string
+		in   string
+		out  time.Time
+		err  bool
+	}{
+		{
+			name: "unix seconds",
+			in:   "1714557600",
+			out:  time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "rfc3339",
+			in:   "2024-05-01T10:00:00Z",
+			out:  time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "rfc3339 with zone",
+			in:   "2024-05-01T12:00:00+02:00",
+			out:  time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "positive duration",
+			in:   "2h",
+			err:  true,
+		},
+		{
+			name: "invalid string",
+			in:   "yesterday",
+			err:  true,
+		},
+		{
+			name: "invalid type",
+			in:   "[1, 2]",
+			err:  true,
+		},
+	}
+
+	for _, tt := range testCases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			var ts Timestamp
+			err := yaml.Unmarshal([]byte(tt.in), &ts)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("Expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !ts.Equal(tt.out) {
+				t.Fatalf("Expected %v, got %v", tt.out, ts.Time)
+			}
+		})
+	}
+}
+
+func TestTimestampUnmarshalYAML_Relative(t *testing.T) {
+	var ts Timestamp
+	if err := yaml.Unmarshal([]byte("-2h"), &ts); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := time.Now().Add(-2 * time.Hour)
+	if d := ts.Sub(expected); d > time.Second || d < -time.Second {
+		t.Fatalf("Expected %v, got %v", expected, ts.Time)
+	}
+}
+
+func TestOffsetUnmarshalYAML(t *testing.T) {
+	testCases := []struct {
+		name string
+		in   string
+		out  Offset
+		err  bool
+	}{
+		{
+			name: "newest",
+			in:   "-1",
+			out:  Offset{Position: OffsetNewest},
+		},
+		{
+			name: "oldest",
+			in:   "-2",
+			out:  Offset{Position: OffsetOldest},
+		},
+		{
+			name: "zero",
+			in:   "0",
+			out:  Offset{},
+		},
+		{
+			name: "invalid position",
+			in:   "-3",
+			err:  true,
+		},
+		{
+			name: "unix seconds",
+			in:   "1714557600",
+			out:  Offset{Time: time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)},
+		},
+		{
+			name: "rfc3339",
+			in:   "2024-05-01T10:00:00Z",
+			out:  Offset{Time: time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)},
+		},
+		{
+			name: "partitions",
+			in:   "{0: 100, 1: -2}",
+			out:  Offset{Partitions: map[int]int64{0: 100, 1: -2}},
+		},
+		{
+			name: "invalid partitions",
+			in:   "{a: 100}",
+			err:  true,
+		},
+		{
+			name: "invalid string",
+			in:   "yesterday",
+			err:  true,
+		},
+	}
+
+	for _, tt := range testCases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			var o Offset
+			err := yaml.Unmarshal([]byte(tt.in), &o)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("Expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if o.Position != tt.out.Position {
+				t.Fatalf("Expected position %d, got %d", tt.out.Position, o.Position)
+			}
+			if !o.Time.Equal(tt.out.Time) {
+				t.Fatalf("Expected time %v, got %v", tt.out.Time, o.Time)
+			}
+			if len(o.Partitions) != len(tt.out.Partitions) {
+				t.Fatalf("Expected partitions %v, got %v", tt.out.Partitions, o.Partitions)
+			}
+			for p, offset := range tt.out.Partitions {
+				if o.Partitions[p] != offset {
+					t.Fatalf("Expected partitions %v, got %v", tt.out.Partitions, o.Partitions)
+				}
+			}
+		})
+	}
+}
+
+func TestFileConfUnmarshalYAML(t *testing.T) {
+	testCases := []struct {
+		name string
+		in   string
+		out  FileConf
+	}{
+		{
+			name: "path",
+			in:   "messages.txt",
+			out:  FileConf{Path: "messages.txt"},
+		},
+		{
+			name: "object",
+			in:   "{path: messages.txt, raw: true}",
+			out:  FileConf{Path: "messages.txt", Raw: true},
+		},
+	}
+
+	for _, tt := range testCases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			var f FileConf
+			if err := yaml.Unmarshal([]byte(tt.in), &f); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if f != tt.out {
+				t.Fatalf("Expected %v, got %v", tt.out, f)
+			}
+		})
+	}
+}
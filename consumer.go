@@ -2,8 +2,11 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"regexp"
+	"strings"
 	"time"
 
 	kafka "github.com/segmentio/kafka-go"
@@ -12,23 +15,48 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-// Message is a kafka message with timestamp.
+// Message is a kafka message with its attributes. The payload is read
+// as raw bytes and decoded later.
 type Message struct {
-	time time.Time
-	data map[string]interface{}
+	time      time.Time
+	topic     string
+	partition int
+	offset    int64
+	key       []byte
+	headers   map[string]string
+	raw       []byte
+	value     interface{}
+	data      map[string]interface{}
 }
 
-// Consumer describes source of messages.
+// envelopeKey is a field that holds payloads that are not objects,
+// e.g. {"value": "text line"}.
+const envelopeKey = "value"
+
+// Consumer describes source of messages. Messages are committed
+// explicitly after they have been processed.
 type Consumer interface {
 	Read(context.Context) (Message, error)
+	Commit(context.Context, ...Message) error
 	Close()
 }
 
-// KafkaConsumer is a consumer that reads messages from kafka.
+// KafkaConsumer is a consumer that reads messages from kafka. It either
+// joins a consumer group, or, when no group is set, reads all partitions
+// directly without committing offsets.
 type KafkaConsumer struct {
-	conf     kafka.ReaderConfig
-	kafka    *kafka.Reader
-	messages chan Message
+	readers  []*kafka.Reader
+	group    *kafka.Reader
+	bounds   *bounds
+	end      <-chan time.Time
+	messages chan fetched
+	cancel   context.CancelFunc
+}
+
+// fetched is a result of reading from one of the readers.
+type fetched struct {
+	msg kafka.Message
+	err error
 }
 
 // NewKafkaConsumer creates new kafka consumer.
@@ -36,110 +64,344 @@ func NewKafkaConsumer(conf KafkaConf) (*KafkaConsumer, error) {
 	if len(conf.Brokers) == 0 {
 		return nil, fmt.Errorf("brokers list is empty")
 	}
-	if conf.Topic == "" {
-		return nil, fmt.Errorf("topic is empty")
+	cl, err := newCluster(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := context.TODO()
+
+	log.Debug("Read partitions list")
+	parts, err := readPartitions(ctx, cl, conf)
+	if err != nil {
+		return nil, fmt.Errorf("read partitions: %v", err)
+	}
+	topics := partitionsTopics(parts)
+	log.Infof("Reading topics: %s", strings.Join(topics, ", "))
+	if conf.Offset.Partitions != nil && len(topics) > 1 {
+		return nil, fmt.Errorf("partitions offsets are only allowed for a single topic")
 	}
-	if conf.GroupID == "" {
-		return nil, fmt.Errorf("group id is empty")
+
+	var readers []*kafka.Reader
+	var start map[topicPartition]int64
+	if conf.GroupID != "" {
+		readers, start, err = groupReaders(ctx, cl, conf, parts)
+	} else {
+		log.Info("No group id, reading partitions without committing offsets")
+		readers, start, err = partitionReaders(ctx, cl, conf, parts)
 	}
-	if conf.Offset == 0 {
-		conf.Offset = -1
+	if err != nil {
+		return nil, err
 	}
 
 	c := &KafkaConsumer{
-		conf: kafka.ReaderConfig{
-			Brokers:        conf.Brokers,
-			Topic:          conf.Topic,
-			GroupID:        conf.GroupID,
-			CommitInterval: time.Second,
-		},
-		messages: make(chan Message),
-	}
-
-	switch conf.Offset {
-	case -1:
-		c.conf.StartOffset = kafka.LastOffset
-	case -2:
-		c.conf.StartOffset = kafka.FirstOffset
-	default:
-		err := setOffset(context.TODO(), conf.Brokers, conf.Topic, conf.GroupID, conf.Offset)
-		if err != nil {
-			return nil, fmt.Errorf("set offsets: %v", err)
+		readers:  readers,
+		messages: make(chan fetched),
+	}
+	if conf.GroupID != "" {
+		c.group = readers[0]
+	}
+
+	if !conf.Until.IsZero() {
+		c.bounds = newBounds(cl, parts, conf.Until.Time, start)
+		if wait := time.Until(conf.Until.Time) + endDelay; wait > 0 {
+			c.end = time.After(wait)
+		} else if err := c.bounds.resolve(ctx); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("get end offsets: %v", err)
 		}
 	}
 
-	c.kafka = kafka.NewReader(c.conf)
+	ctx, c.cancel = context.WithCancel(context.Background())
+	for _, r := range c.readers {
+		go c.fetch(ctx, r)
+	}
 
 	return c, nil
 }
 
-// Read reads next message from kafka.
-func (c *KafkaConsumer) Read(ctx context.Context) (Message, error) {
-	msg, err := c.kafka.ReadMessage(ctx)
+// groupReaders creates a reader that consumes topics as a member of
+// the consumer group. The group continues from its committed offsets,
+// newest or oldest position only applies to partitions without them.
+// Start time and partitions offsets are committed to the group on start.
+func groupReaders(
+	ctx context.Context,
+	cl *cluster,
+	conf KafkaConf,
+	parts []kafka.Partition,
+) ([]*kafka.Reader, map[topicPartition]int64, error) {
+	topics := partitionsTopics(parts)
+	rconf := kafka.ReaderConfig{
+		Brokers:        cl.brokers,
+		GroupID:        conf.GroupID,
+		CommitInterval: time.Second,
+		Dialer:         cl.dialer,
+	}
+	if len(topics) == 1 {
+		rconf.Topic = topics[0]
+	} else {
+		rconf.GroupTopics = topics
+	}
+
+	var start map[topicPartition]int64
+	var err error
+	if conf.Offset.Time.IsZero() && conf.Offset.Partitions == nil {
+		start, err = readCommittedOffsets(ctx, cl, conf.GroupID, parts, conf.Offset.Position)
+	} else {
+		start, err = resolveOffsets(ctx, cl, parts, conf.Offset)
+	}
 	if err != nil {
-		return Message{}, fmt.Errorf("read message: %v", err)
+		return nil, nil, fmt.Errorf("get offsets: %v", err)
+	}
+	log.Infof("Start offsets: %s", formatOffsets(start))
+	if err := setOffset(ctx, cl, conf.GroupID, start); err != nil {
+		return nil, nil, fmt.Errorf("set offsets: %v", err)
 	}
 
-	var data map[string]interface{}
-	if err := json.Unmarshal(msg.Value, &data); err != nil {
-		return Message{}, fmt.Errorf("invalid json: %s", msg.Value)
+	return []*kafka.Reader{kafka.NewReader(rconf)}, start, nil
+}
+
+// partitionReaders creates a reader for each partition of the topics,
+// starting from the resolved offsets.
+func partitionReaders(
+	ctx context.Context,
+	cl *cluster,
+	conf KafkaConf,
+	parts []kafka.Partition,
+) ([]*kafka.Reader, map[topicPartition]int64, error) {
+	start, err := resolveOffsets(ctx, cl, parts, conf.Offset)
+	if err != nil {
+		return nil, nil, fmt.Errorf("get offsets: %v", err)
+	}
+	log.Infof("Start offsets: %s", formatOffsets(start))
+
+	readers := make([]*kafka.Reader, 0, len(parts))
+	for _, p := range parts {
+		r := kafka.NewReader(kafka.ReaderConfig{
+			Brokers:   cl.brokers,
+			Topic:     p.Topic,
+			Partition: p.ID,
+			Dialer:    cl.dialer,
+		})
+		if err := r.SetOffset(start[partitionOf(p)]); err != nil {
+			r.Close() // nolint: errcheck,gosec
+			for _, r := range readers {
+				r.Close() // nolint: errcheck,gosec
+			}
+			return nil, nil, fmt.Errorf("set offset of %s: %v", partitionOf(p), err)
+		}
+		readers = append(readers, r)
+	}
+	return readers, start, nil
+}
+
+// fetch reads messages from the reader until the context is canceled.
+func (c *KafkaConsumer) fetch(ctx context.Context, r *kafka.Reader) {
+	for {
+		msg, err := r.FetchMessage(ctx)
+		if ctx.Err() != nil || err == io.EOF {
+			return
+		}
+		select {
+		case c.messages <- fetched{msg: msg, err: err}:
+		case <-ctx.Done():
+			return
+		}
 	}
+}
+
+// Read reads next message from kafka. The payload is not decoded.
+// It returns io.EOF when the end of a bounded dump is reached.
+func (c *KafkaConsumer) Read(ctx context.Context) (Message, error) {
+	for {
+		if c.bounds != nil && c.bounds.finished() {
+			return Message{}, io.EOF
+		}
+		var f fetched
+		select {
+		case <-ctx.Done():
+			return Message{}, ctx.Err()
+		case <-c.end:
+			// The end time has passed, so partitions without new
+			// messages are finished by their end offsets
+			c.end = nil
+			if err := c.bounds.resolve(ctx); err != nil {
+				return Message{}, fmt.Errorf("get end offsets: %v", err)
+			}
+			continue
+		case f = <-c.messages:
+		}
+		if f.err != nil {
+			return Message{}, fmt.Errorf("read message: %v", f.err)
+		}
+		if c.bounds == nil || c.bounds.check(f.msg) {
+			return newMessage(f.msg), nil
+		}
+	}
+}
+
+// errTombstone is an error for messages with null payload, that are used
+// in compacted topics to delete keys.
+var errTombstone = errors.New("tombstone")
 
-	return Message{time: msg.Time, data: data}, nil
+// InvalidMessageError is an error for messages that cannot be decoded.
+type InvalidMessageError struct {
+	Message Message
+	Err     error
 }
 
-// Close properly closes kafka connection.
+func (e *InvalidMessageError) Error() string {
+	return fmt.Sprintf(
+		"invalid message %s/%d at offset %d: %v",
+		e.Message.topic, e.Message.partition, e.Message.offset, e.Err,
+	)
+}
+
+func (e *InvalidMessageError) Unwrap() error {
+	return e.Err
+}
+
+// newMessage creates a message from kafka message.
+func newMessage(msg kafka.Message) Message {
+	var headers map[string]string
+	if len(msg.Headers) > 0 {
+		headers = make(map[string]string, len(msg.Headers))
+		for _, h := range msg.Headers {
+			headers[h.Key] = string(h.Value)
+		}
+	}
+	return Message{
+		time:      msg.Time,
+		topic:     msg.Topic,
+		partition: msg.Partition,
+		offset:    msg.Offset,
+		key:       msg.Key,
+		headers:   headers,
+		raw:       msg.Value,
+	}
+}
+
+// decode decodes the raw payload. Payloads that are not objects are wrapped
+// into an envelope.
+func (m *Message) decode(dec Decoder) error {
+	if m.raw == nil {
+		return &InvalidMessageError{Message: *m, Err: errTombstone}
+	}
+	value, err := dec.Decode(m.raw)
+	if err != nil {
+		return &InvalidMessageError{Message: *m, Err: err}
+	}
+	data, ok := value.(map[string]interface{})
+	if !ok {
+		data = map[string]interface{}{envelopeKey: value}
+	}
+	m.value = value
+	m.data = data
+	return nil
+}
+
+// Commit commits offsets of processed messages to the consumer group.
+// It does nothing when there is no group.
+func (c *KafkaConsumer) Commit(ctx context.Context, msgs ...Message) error {
+	if c.group == nil || len(msgs) == 0 {
+		return nil
+	}
+	kmsgs := make([]kafka.Message, len(msgs))
+	for i, msg := range msgs {
+		kmsgs[i] = kafka.Message{
+			Topic:     msg.topic,
+			Partition: msg.partition,
+			Offset:    msg.offset,
+		}
+	}
+	return c.group.CommitMessages(ctx, kmsgs...)
+}
+
+// Close properly closes kafka connections, pending offsets are committed.
 func (c *KafkaConsumer) Close() {
-	c.kafka.Close() // nolint: errcheck,gosec
+	if c.cancel != nil {
+		c.cancel()
+	}
+	for _, r := range c.readers {
+		r.Close() // nolint: errcheck,gosec
+	}
 }
 
-func setOffset(ctx context.Context, brokers []string, topic, gid string, ts int64) error {
-	conn, err := kafka.DialContext(ctx, "tcp", brokers[0])
+// readPartitions gets partitions of all topics to read. Topics are set
+// either by names, or by a regular expression matched against all topics
+// of the cluster, except the internal ones.
+func readPartitions(ctx context.Context, cl *cluster, conf KafkaConf) ([]kafka.Partition, error) {
+	topics, err := configTopics(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := cl.dial(ctx)
 	if err != nil {
-		return fmt.Errorf("create connection: %v", err)
+		return nil, fmt.Errorf("create connection: %v", err)
 	}
 	defer conn.Close() // nolint: errcheck
 
-	log.Debug("Read partitions list")
-	parts, err := conn.ReadPartitions(topic)
+	all, err := conn.ReadPartitions()
 	if err != nil {
-		return fmt.Errorf("get partitions: %v", err)
+		return nil, fmt.Errorf("get partitions: %v", err)
 	}
+	return selectPartitions(all, topics, conf.TopicRegex)
+}
 
-	log.Debugf("Get offsets by timestamp %s", time.Unix(ts, 0))
-	offsets := make(map[int]int64, len(parts))
-	for _, p := range parts {
-		addr := fmt.Sprintf("%s:%d", p.Leader.Host, p.Leader.Port)
-		c, err := kafka.DialLeader(ctx, "tcp", addr, topic, p.ID)
+// configTopics gets the list of topics from config, and checks that
+// topics are set either by names or by a regular expression.
+func configTopics(conf KafkaConf) ([]string, error) {
+	topics := conf.Topics
+	if conf.Topic != "" {
+		topics = append([]string{conf.Topic}, topics...)
+	}
+	if len(topics) == 0 && conf.TopicRegex == "" {
+		return nil, fmt.Errorf("no topics specified")
+	}
+	if len(topics) > 0 && conf.TopicRegex != "" {
+		return nil, fmt.Errorf("topics and topic regex cannot be used together")
+	}
+	return topics, nil
+}
+
+// selectPartitions gets partitions of the topics, or of the topics
+// matching the regular expression.
+func selectPartitions(all []kafka.Partition, topics []string, regex string) ([]kafka.Partition, error) {
+	var match func(topic string) bool
+	if regex != "" {
+		re, err := regexp.Compile(regex)
 		if err != nil {
-			return fmt.Errorf("create connection to partition %d: %v", p.ID, err)
+			return nil, fmt.Errorf("invalid topic regex: %v", err)
 		}
-		defer c.Close() // nolint: errcheck
-		offset, err := c.ReadOffset(time.Unix(ts, 0))
-		if err != nil {
-			return fmt.Errorf("read offset of partition %d: %v", p.ID, err)
+		match = func(topic string) bool {
+			return !strings.HasPrefix(topic, "__") && re.MatchString(topic)
+		}
+	} else {
+		names := make(map[string]bool, len(topics))
+		for _, t := range topics {
+			names[t] = true
+		}
+		match = func(topic string) bool {
+			return names[topic]
 		}
-		offsets[p.ID] = offset
 	}
 
-	log.Debugf("Set offsets (%d partitions) for %s/%s", len(parts), topic, gid)
-	group, err := kafka.NewConsumerGroup(kafka.ConsumerGroupConfig{
-		Brokers: brokers,
-		Topics:  []string{topic},
-		ID:      gid,
-	})
-	if err != nil {
-		return fmt.Errorf("create consumer group: %v", err)
+	var parts []kafka.Partition
+	found := map[string]bool{}
+	for _, p := range all {
+		if match(p.Topic) {
+			parts = append(parts, p)
+			found[p.Topic] = true
+		}
 	}
-	defer group.Close() // nolint: errcheck
-
-	gen, err := group.Next(ctx)
-	if err != nil {
-		return fmt.Errorf("get next generation: %v", err)
+	for _, t := range topics {
+		if !found[t] {
+			return nil, fmt.Errorf("topic %s not found", t)
+		}
 	}
-	err = gen.CommitOffsets(map[string]map[int]int64{topic: offsets})
-	if err != nil {
-		return fmt.Errorf("commit offsets: %v", err)
+	if len(parts) == 0 {
+		return nil, fmt.Errorf("no topics match %s", regex)
 	}
-	return nil
+	return parts, nil
 }
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	kafka "github.com/segmentio/kafka-go"
+)
+
+func TestConfigTopics(t *testing.T) {
+	testCases := []struct {
+		name   string
+		conf   KafkaConf
+		topics []string
+		err    bool
+	}{
+		{
+			name:   "single topic",
+			conf:   KafkaConf{Topic: "orders"},
+			topics: []string{"orders"},
+		},
+		{
+			name:   "topic and list",
+			conf:   KafkaConf{Topic: "orders", Topics: []string{"payments"}},
+			topics: []string{"orders", "payments"},
+		},
+		{
+			name: "regex",
+			conf: KafkaConf{TopicRegex: "^orders"},
+		},
+		{
+			name: "no topics",
+			conf: KafkaConf{},
+			err:  true,
+		},
+		{
+			name: "list and regex",
+			conf: KafkaConf{Topics: []string{"orders"}, TopicRegex: "^orders"},
+			err:  true,
+		},
+		{
+			name: "topic and regex",
+			conf: KafkaConf{Topic: "orders", TopicRegex: "^orders"},
+			err:  true,
+		},
+	}
+
+	for _, tt := range testCases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			topics, err := configTopics(tt.conf)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("Expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(topics, tt.topics) {
+				t.Fatalf("Expected %v, got %v", tt.topics, topics)
+			}
+		})
+	}
+}
+
+func TestSelectPartitions(t *testing.T) {
+	all := []kafka.Partition{
+		{Topic: "orders.eu", ID: 0},
+		{Topic: "orders.eu", ID: 1},
+		{Topic: "orders.us", ID: 0},
+		{Topic: "payments", ID: 0},
+		{Topic: "__consumer_offsets", ID: 0},
+	}
+
+	testCases := []struct {
+		name   string
+		topics []string
+		regex  string
+		parts  []string
+		err    bool
+	}{
+		{
+			name:   "topics list",
+			topics: []string{"payments", "orders.us"},
+			parts:  []string{"orders.us/0", "payments/0"},
+		},
+		{
+			name:   "unknown topic",
+			topics: []string{"payments", "refunds"},
+			err:    true,
+		},
+		{
+			name:  "regex",
+			regex: `^orders\.`,
+			parts: []string{"orders.eu/0", "orders.eu/1", "orders.us/0"},
+		},
+		{
+			name:  "regex skips internal topics",
+			regex: "offsets",
+			err:   true,
+		},
+		{
+			name:  "regex matches nothing",
+			regex: "^refunds$",
+			err:   true,
+		},
+		{
+			name:  "invalid regex",
+			regex: "orders(",
+			err:   true,
+		},
+	}
+
+	for _, tt := range testCases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			parts, err := selectPartitions(all, tt.topics, tt.regex)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("Expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			names := make([]string, len(parts))
+			for i, p := range parts {
+				names[i] = partitionOf(p).String()
+			}
+			if !reflect.DeepEqual(names, tt.parts) {
+				t.Fatalf("Expected %v, got %v", tt.parts, names)
+			}
+		})
+	}
+}
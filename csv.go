@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+// CSVStorage is a storage that saves messages to a CSV file, one row per
+// message. Columns are payload fields, or kafka message attributes: $time,
+// $key, $topic, $partition, $offset and $header.<name>.
+type CSVStorage struct {
+	file    *os.File
+	writer  *csv.Writer
+	columns []field
+}
+
+// NewCSVStorage creates new CSV storage and writes the header row.
+func NewCSVStorage(conf CSVConf) (*CSVStorage, error) {
+	columns, err := parseColumns(conf.Columns)
+	if err != nil {
+		return nil, err
+	}
+	delimiter, err := parseDelimiter(conf.Delimiter)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(conf.Path, os.O_RDWR|os.O_TRUNC|os.O_CREATE, 0o600) // nolint: gosec
+	if err != nil {
+		return nil, fmt.Errorf("open file %s: %v", conf.Path, err)
+	}
+	w := csv.NewWriter(f)
+	w.Comma = delimiter
+
+	s := &CSVStorage{file: f, writer: w, columns: columns}
+	if !conf.NoHeader {
+		if err := s.write(conf.Columns); err != nil {
+			f.Close() // nolint: errcheck,gosec
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Save saves a message as a row to the file.
+func (s *CSVStorage) Save(msg Message) error {
+	row := make([]string, len(s.columns))
+	for i, col := range s.columns {
+		val, ok := col(msg)
+		if !ok {
+			continue
+		}
+		cell, err := formatCell(val)
+		if err != nil {
+			return fmt.Errorf("format column %d: %v", i, err)
+		}
+		row[i] = cell
+	}
+	return s.write(row)
+}
+
+func (s *CSVStorage) write(row []string) error {
+	if err := s.writer.Write(row); err != nil {
+		return fmt.Errorf("write data to file: %v", err)
+	}
+	s.writer.Flush()
+	if err := s.writer.Error(); err != nil {
+		return fmt.Errorf("write data to file: %v", err)
+	}
+	return nil
+}
+
+// Flush commits saved rows to disk.
+func (s *CSVStorage) Flush() error {
+	if err := s.file.Sync(); err != nil {
+		return fmt.Errorf("sync file: %v", err)
+	}
+	return nil
+}
+
+// Close properly closes the file.
+func (s *CSVStorage) Close() {
+	s.file.Close() // nolint: errcheck,gosec
+}
+
+// parseColumns creates field extractors for the columns. Besides the fields
+// supported by filters, $time column is the time of the message.
+func parseColumns(names []string) ([]field, error) {
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no columns specified")
+	}
+	columns := make([]field, len(names))
+	for i, name := range names {
+		if name == "$time" {
+			columns[i] = func(msg Message) (interface{}, bool) {
+				return msg.time, !msg.time.IsZero()
+			}
+			continue
+		}
+		f, ok := parseField(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown column %s", name)
+		}
+		columns[i] = f
+	}
+	return columns, nil
+}
+
+// parseDelimiter parses a single character delimiter, comma by default.
+func parseDelimiter(s string) (rune, error) {
+	if s == "" {
+		return ',', nil
+	}
+	r, size := utf8.DecodeRuneInString(s)
+	if size != len(s) || r == utf8.RuneError || r == '"' || r == '\r' || r == '\n' {
+		return 0, fmt.Errorf("invalid delimiter %q", s)
+	}
+	return r, nil
+}
+
+// formatCell converts a value to a cell. Objects and lists are encoded
+// as JSON.
+func formatCell(val interface{}) (string, error) {
+	switch v := val.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case time.Time:
+		return v.Format(time.RFC3339Nano), nil
+	default:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return "", err
+		}
+		return string(b), nil
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCSVStorage(t *testing.T) {
+	messages := []Message{
+		{
+			time:      time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC),
+			partition: 3,
+			key:       []byte("customer-1"),
+			raw:       []byte(`{"id": 1, "note": "say \"hi\", bye", "user": {"id": 42}, "tags": ["a", "b"]}`),
+		},
+		{
+			time:      time.Date(2024, 5, 1, 10, 0, 1, 0, time.UTC),
+			partition: 0,
+			raw:       []byte(`{"id": 2, "amount": 10.50}`),
+		},
+	}
+
+	testCases := []struct {
+		name string
+		conf CSVConf
+		out  string
+	}{
+		{
+			name: "csv",
+			conf: CSVConf{Columns: []string{"$time", "$partition", "$key", "id", "note", "user", "tags[1]", "amount"}},
+			out: "$time,$partition,$key,id,note,user,tags[1],amount\n" +
+				"2024-05-01T10:00:00Z,3,customer-1,1,\"say \"\"hi\"\", bye\",\"{\"\"id\"\":42}\",b,\n" +
+				"2024-05-01T10:00:01Z,0,,2,,,,10.50\n",
+		},
+		{
+			name: "tsv without header",
+			conf: CSVConf{Columns: []string{"id", "user.id"}, Delimiter: "\t", NoHeader: true},
+			out:  "1\t42\n2\t\n",
+		},
+	}
+
+	for _, tt := range testCases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "messages.csv")
+			tt.conf.Path = file
+			s, err := NewCSVStorage(tt.conf)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			for _, msg := range messages {
+				if err := msg.decode(&JSONDecoder{}); err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				if err := s.Save(msg); err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+			}
+			s.Close()
+
+			data, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if string(data) != tt.out {
+				t.Fatalf("Expected %q, got %q", tt.out, string(data))
+			}
+		})
+	}
+}
+
+func TestNewCSVStorage_Error(t *testing.T) {
+	testCases := []struct {
+		name string
+		conf CSVConf
+		err  string
+	}{
+		{
+			name: "no columns",
+			conf: CSVConf{},
+			err:  "no columns specified",
+		},
+		{
+			name: "unknown column",
+			conf: CSVConf{Columns: []string{"id", "$size"}},
+			err:  "unknown column $size",
+		},
+		{
+			name: "invalid delimiter",
+			conf: CSVConf{Columns: []string{"id"}, Delimiter: ";;"},
+			err:  `invalid delimiter ";;"`,
+		},
+	}
+
+	for _, tt := range testCases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			tt.conf.Path = filepath.Join(t.TempDir(), "messages.csv")
+			_, err := NewCSVStorage(tt.conf)
+			if err == nil || err.Error() != tt.err {
+				t.Fatalf("Expected %v, got %v", tt.err, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// DeadLetter is a file for messages that cannot be decoded. Each message
+// is written as a single JSON line with its attributes, the error, and
+// the raw payload. Binary key and payload are encoded in base64.
+type DeadLetter struct {
+	file *os.File
+}
+
+// deadLetterRecord is a line of a dead letter file.
+type deadLetterRecord struct {
+	Time      time.Time         `json:"time"`
+	Topic     string            `json:"topic"`
+	Partition int               `json:"partition"`
+	Offset    int64             `json:"offset"`
+	Key       []byte            `json:"key"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	Error     string            `json:"error"`
+	Value     []byte            `json:"value"`
+}
+
+// NewDeadLetter creates new dead letter file, or opens the existing one
+// for appending.
+func NewDeadLetter(file string) (*DeadLetter, error) {
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600) // nolint: gosec
+	if err != nil {
+		return nil, fmt.Errorf("open file %s: %v", file, err)
+	}
+	return &DeadLetter{file: f}, nil
+}
+
+// Write saves an invalid message to the file.
+func (d *DeadLetter) Write(e *InvalidMessageError) error {
+	data, err := json.Marshal(deadLetterRecord{
+		Time:      e.Message.time,
+		Topic:     e.Message.topic,
+		Partition: e.Message.partition,
+		Offset:    e.Message.offset,
+		Key:       e.Message.key,
+		Headers:   e.Message.headers,
+		Error:     e.Err.Error(),
+		Value:     e.Message.raw,
+	})
+	if err != nil {
+		return fmt.Errorf("marshall message: %v", err)
+	}
+	_, err = d.file.Write(append(data, '\n'))
+	if err != nil {
+		return fmt.Errorf("write data to file: %v", err)
+	}
+	return nil
+}
+
+// Flush commits written messages to disk.
+func (d *DeadLetter) Flush() error {
+	if err := d.file.Sync(); err != nil {
+		return fmt.Errorf("sync file: %v", err)
+	}
+	return nil
+}
+
+// Close properly closes the file.
+func (d *DeadLetter) Close() {
+	d.file.Close() // nolint: errcheck,gosec
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDeadLetterWrite(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "dead.jsonl")
+	dl, err := NewDeadLetter(file)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	ts := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	err = dl.Write(&InvalidMessageError{
+		Message: Message{
+			time:      ts,
+			topic:     "orders",
+			partition: 3,
+			offset:    42,
+			key:       []byte("customer-1"),
+			raw:       []byte{0xff, 0x00, '{'},
+		},
+		Err: errTombstone,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	dl.Close()
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	want := map[string]interface{}{
+		"time":      "2024-05-01T10:00:00Z",
+		"topic":     "orders",
+		"partition": float64(3),
+		"offset":    float64(42),
+		"key":       "Y3VzdG9tZXItMQ==",
+		"error":     "tombstone",
+		"value":     "/wB7",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Expected %v, got %v", want, got)
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/linkedin/goavro/v2"
+	"golang.org/x/sync/singleflight"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// Payload formats.
+const (
+	FormatJSON     = "json"
+	FormatJSONAny  = "json-any"
+	FormatText     = "text"
+	FormatBytes    = "bytes"
+	FormatBase64   = "base64"
+	FormatAvro     = "avro"
+	FormatProtobuf = "protobuf"
+)
+
+const (
+	registryTimeout = 10 * time.Second
+	// registryRetryDelay is a time during which failed schema requests are
+	// not retried, and messages with the schema are rejected right away
+	registryRetryDelay = 5 * time.Second
+)
+
+// Decoder converts a kafka message payload to a value. Objects are
+// represented as maps of fields, other values are wrapped into envelopes
+// when messages are decoded (see Message.decode).
+type Decoder interface {
+	Decode([]byte) (interface{}, error)
+}
+
+// NewDecoder creates a decoder for the payload format from config.
+func NewDecoder(conf Config) (Decoder, error) {
+	switch conf.PayloadFormat {
+	case "", FormatJSON:
+		return &JSONDecoder{}, nil
+	case FormatJSONAny:
+		return &JSONDecoder{any: true}, nil
+	case FormatText:
+		return &TextDecoder{}, nil
+	case FormatBytes, FormatBase64:
+		return &BytesDecoder{}, nil
+	case FormatAvro:
+		return NewAvroDecoder(conf.SchemaRegistry)
+	case FormatProtobuf:
+		return NewProtobufDecoder(conf.Protobuf)
+	default:
+		return nil, fmt.Errorf("unknown payload format: %s", conf.PayloadFormat)
+	}
+}
+
+// JSONDecoder is a decoder for JSON values. By default only objects
+// are accepted.
+type JSONDecoder struct {
+	any bool
+}
+
+// Decode decodes a JSON value.
+func (d *JSONDecoder) Decode(value []byte) (interface{}, error) {
+	if d.any {
+		var data interface{}
+		if err := unmarshalJSON(value, &data); err != nil {
+			return nil, fmt.Errorf("invalid json: %v", err)
+		}
+		return data, nil
+	}
+	var data map[string]interface{}
+	if err := unmarshalJSON(value, &data); err != nil {
+		return nil, fmt.Errorf("invalid json: %v", err)
+	}
+	return data, nil
+}
+
+// unmarshalJSON works like json.Unmarshal, but keeps numbers as json.Number,
+// so large integers don't lose precision.
+func unmarshalJSON(b []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return fmt.Errorf("unexpected data after json value")
+	}
+	return nil
+}
+
+// TextDecoder is a decoder for plain text, e.g. log lines.
+type TextDecoder struct{}
+
+// Decode converts the payload to a string.
+func (d *TextDecoder) Decode(value []byte) (interface{}, error) {
+	return string(value), nil
+}
+
+// BytesDecoder is a decoder for binary data.
+type BytesDecoder struct{}
+
+// Decode converts the payload to a base64 string.
+func (d *BytesDecoder) Decode(value []byte) (interface{}, error) {
+	return base64.StdEncoding.EncodeToString(value), nil
+}
+
+// AvroDecoder is a decoder for Avro records in Confluent wire format:
+// a zero magic byte, 4 bytes of schema ID, and Avro binary data.
+// Schemas are fetched from a schema registry and cached by their IDs.
+type AvroDecoder struct {
+	registry SchemaRegistryConf
+	client   *http.Client
+	fetches  singleflight.Group
+
+	mx     sync.Mutex
+	codecs map[uint32]*goavro.Codec
+	failed map[uint32]schemaError
+}
+
+// schemaError is a failed schema request, that is not retried until
+// the given time.
+type schemaError struct {
+	err   error
+	until time.Time
+}
+
+// NewAvroDecoder creates new Avro decoder.
+func NewAvroDecoder(conf SchemaRegistryConf) (*AvroDecoder, error) {
+	if conf.URL == "" {
+		return nil, fmt.Errorf("schema registry url is empty")
+	}
+	conf.URL = strings.TrimSuffix(conf.URL, "/")
+	d := &AvroDecoder{
+		registry: conf,
+		client:   &http.Client{Timeout: registryTimeout},
+		codecs:   map[uint32]*goavro.Codec{},
+		failed:   map[uint32]schemaError{},
+	}
+	return d, nil
+}
+
+// Decode decodes an Avro value.
+func (d *AvroDecoder) Decode(value []byte) (interface{}, error) {
+	if len(value) < 5 || value[0] != 0 {
+		return nil, fmt.Errorf("invalid avro message: no schema id")
+	}
+	id := binary.BigEndian.Uint32(value[1:5])
+
+	codec, err := d.codec(id)
+	if err != nil {
+		return nil, fmt.Errorf("get schema %d: %v", id, err)
+	}
+
+	native, _, err := codec.NativeFromBinary(value[5:])
+	if err != nil {
+		return nil, fmt.Errorf("decode avro message with schema %d: %v", id, err)
+	}
+	return native, nil
+}
+
+// codec gets a codec from cache, or fetches its schema from the registry.
+// Concurrent requests of the same schema are merged, and failed requests
+// are not retried for a while.
+func (d *AvroDecoder) codec(id uint32) (*goavro.Codec, error) {
+	d.mx.Lock()
+	codec, ok := d.codecs[id]
+	failed, isFailed := d.failed[id]
+	d.mx.Unlock()
+	if ok {
+		return codec, nil
+	}
+	if isFailed && time.Now().Before(failed.until) {
+		return nil, failed.err
+	}
+
+	v, err, _ := d.fetches.Do(strconv.FormatUint(uint64(id), 10), func() (interface{}, error) {
+		codec, err := d.newCodec(id)
+
+		d.mx.Lock()
+		defer d.mx.Unlock()
+		if err != nil {
+			d.failed[id] = schemaError{err: err, until: time.Now().Add(registryRetryDelay)}
+			return nil, err
+		}
+		delete(d.failed, id)
+		d.codecs[id] = codec
+		return codec, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*goavro.Codec), nil
+}
+
+// newCodec fetches a schema from the registry and creates its codec.
+func (d *AvroDecoder) newCodec(id uint32) (*goavro.Codec, error) {
+	schema, err := d.fetchSchema(id)
+	if err != nil {
+		return nil, err
+	}
+	codec, err := goavro.NewCodec(schema)
+	if err != nil {
+		return nil, fmt.Errorf("parse schema: %v", err)
+	}
+	return codec, nil
+}
+
+func (d *AvroDecoder) fetchSchema(id uint32) (string, error) {
+	url := fmt.Sprintf("%s/schemas/ids/%d", d.registry.URL, id)
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return "", fmt.Errorf("create request: %v", err)
+	}
+	if d.registry.Username != "" {
+		req.SetBasicAuth(d.registry.Username, d.registry.Password)
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("send request: %v", err)
+	}
+	defer resp.Body.Close() // nolint: errcheck
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected response status: %s", resp.Status)
+	}
+	var body struct {
+		Schema string `json:"schema"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("decode response: %v", err)
+	}
+	return body.Schema, nil
+}
+
+// ProtobufDecoder is a decoder for protobuf messages of a single type.
+// The type is loaded from a compiled FileDescriptorSet, e.g. produced by
+// `protoc --include_imports --descriptor_set_out`. Messages are converted
+// to maps using proto3 JSON mapping.
+type ProtobufDecoder struct {
+	desc protoreflect.MessageDescriptor
+}
+
+// NewProtobufDecoder creates new protobuf decoder.
+func NewProtobufDecoder(conf ProtobufConf) (*ProtobufDecoder, error) {
+	if conf.DescriptorSet == "" {
+		return nil, fmt.Errorf("protobuf descriptor set is empty")
+	}
+	if conf.Message == "" {
+		return nil, fmt.Errorf("protobuf message name is empty")
+	}
+
+	b, err := ioutil.ReadFile(conf.DescriptorSet)
+	if err != nil {
+		return nil, fmt.Errorf("read descriptor set: %v", err)
+	}
+	var set descriptorpb.FileDescriptorSet
+	if err := proto.Unmarshal(b, &set); err != nil {
+		return nil, fmt.Errorf("parse descriptor set: %v", err)
+	}
+	files, err := protodesc.NewFiles(&set)
+	if err != nil {
+		return nil, fmt.Errorf("load descriptor set: %v", err)
+	}
+
+	desc, err := files.FindDescriptorByName(protoreflect.FullName(conf.Message))
+	if err != nil {
+		return nil, fmt.Errorf("find message %s: %v", conf.Message, err)
+	}
+	msgDesc, ok := desc.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a message", conf.Message)
+	}
+	return &ProtobufDecoder{desc: msgDesc}, nil
+}
+
+// Decode decodes a protobuf message.
+func (d *ProtobufDecoder) Decode(value []byte) (interface{}, error) {
+	msg := dynamicpb.NewMessage(d.desc)
+	if err := proto.Unmarshal(value, msg); err != nil {
+		return nil, fmt.Errorf("decode protobuf message %s: %v", d.desc.FullName(), err)
+	}
+	b, err := protojson.Marshal(msg)
+	if err != nil {
+		return nil, fmt.Errorf("convert protobuf message %s to json: %v", d.desc.FullName(), err)
+	}
+	var data map[string]interface{}
+	if err := unmarshalJSON(b, &data); err != nil {
+		return nil, fmt.Errorf("convert protobuf message %s to json: %v", d.desc.FullName(), err)
+	}
+	return data, nil
+}
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/linkedin/goavro/v2"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+const testAvroSchema = `{
+	"type": "record",
+	"name": "Order",
+	"fields": [
+		{"name": "id", "type": "long"},
+		{"name": "status", "type": "string"},
+		{"name": "amount", "type": "double"}
+	]
+}`
+
+// testRegistry starts a schema registry stand-in that serves the schema
+// with id 42, and counts requests.
+func testRegistry(t *testing.T, requests *int) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*requests++
+		if r.URL.Path != "/schemas/ids/42" {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"schema": testAvroSchema}) // nolint: errcheck,gosec
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// testAvroMessage encodes the record in Confluent wire format.
+func testAvroMessage(t *testing.T, id uint32, record map[string]interface{}) []byte {
+	codec, err := goavro.NewCodec(testAvroSchema)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	header := make([]byte, 5)
+	binary.BigEndian.PutUint32(header[1:], id)
+	value, err := codec.BinaryFromNative(header, record)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return value
+}
+
+func TestJSONDecoder(t *testing.T) {
+	d := &JSONDecoder{}
+
+	value, err := d.Decode([]byte(`{"type": "foo", "value": 10}`))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if data, ok := value.(map[string]interface{}); !ok || data["type"] != "foo" {
+		t.Fatalf("Unexpected data: %v", value)
+	}
+
+	if _, err := d.Decode([]byte(`not a json`)); err == nil {
+		t.Fatalf("Expected error, got nil")
+	}
+	if _, err := d.Decode([]byte(`[1, 2, 3]`)); err == nil {
+		t.Fatalf("Expected error, got nil")
+	}
+}
+
+func TestJSONDecoder_LargeIntegers(t *testing.T) {
+	d := &JSONDecoder{}
+
+	// 2^53 + 1 cannot be represented as float64
+	value, err := d.Decode([]byte(`{"id": 9007199254740993, "amount": 10.5}`))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	data, _ := value.(map[string]interface{})
+	if data["id"] != json.Number("9007199254740993") {
+		t.Fatalf("Unexpected data: %v", data)
+	}
+
+	b, err := json.Marshal(data)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if string(b) != `{"amount":10.5,"id":9007199254740993}` {
+		t.Fatalf("Unexpected json: %s", b)
+	}
+
+	testCases := []struct {
+		filter interface{}
+		result bool
+	}{
+		{filter: 9007199254740993, result: true},
+		{filter: "9007199254740993", result: true},
+		{filter: 9007199254740992, result: false},
+		{filter: map[string]interface{}{"$gt": 9007199254740992}, result: true},
+		{filter: map[string]interface{}{"$lt": 9007199254740993}, result: false},
+		{filter: map[string]interface{}{"$in": []interface{}{1, 9007199254740993}}, result: true},
+	}
+	for _, tt := range testCases {
+		f, err := NewFieldFilter(map[string]interface{}{"id": tt.filter})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if result := f.Check(Message{data: data}); result != tt.result {
+			t.Fatalf("Filter %v: expected %v, got %v", tt.filter, tt.result, result)
+		}
+	}
+}
+
+func TestJSONDecoder_TrailingData(t *testing.T) {
+	d := &JSONDecoder{}
+	if _, err := d.Decode([]byte(`{"id": 1} {"id": 2}`)); err == nil {
+		t.Fatalf("Expected error, got nil")
+	}
+}
+
+func TestNewMessage_Envelope(t *testing.T) {
+	testCases := []struct {
+		name    string
+		decoder Decoder
+		payload string
+		value   interface{}
+		filter  map[string]interface{}
+	}{
+		{
+			name:    "json object",
+			decoder: &JSONDecoder{any: true},
+			payload: `{"type": "foo"}`,
+			filter:  map[string]interface{}{"type": "foo"},
+		},
+		{
+			name:    "json array",
+			decoder: &JSONDecoder{any: true},
+			payload: `[1, 2, 3]`,
+			filter:  map[string]interface{}{"value[1]": 2},
+		},
+		{
+			name:    "json scalar",
+			decoder: &JSONDecoder{any: true},
+			payload: `"hello"`,
+			value:   "hello",
+			filter:  map[string]interface{}{"$value": "hello"},
+		},
+		{
+			name:    "text",
+			decoder: &TextDecoder{},
+			payload: `2024-05-01 ERROR connection refused`,
+			value:   "2024-05-01 ERROR connection refused",
+			filter: map[string]interface{}{
+				"$value": map[string]interface{}{"$regex": `\bERROR\b`},
+			},
+		},
+		{
+			name:    "csv row",
+			decoder: &TextDecoder{},
+			payload: `1,foo,10.5`,
+			value:   "1,foo,10.5",
+			filter: map[string]interface{}{
+				"value": map[string]interface{}{"$glob": "1,*"},
+			},
+		},
+		{
+			name:    "bytes",
+			decoder: &BytesDecoder{},
+			payload: "\x00\x01\x02",
+			value:   "AAEC",
+			filter:  map[string]interface{}{"$value": "AAEC"},
+		},
+	}
+
+	for _, tt := range testCases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			msg := Message{raw: []byte(tt.payload)}
+			if err := msg.decode(tt.decoder); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if tt.value != nil && msg.data[envelopeKey] != tt.value {
+				t.Fatalf("Expected envelope with %v, got %v", tt.value, msg.data)
+			}
+			f, err := NewFieldFilter(tt.filter)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !f.Check(msg) {
+				t.Fatalf("Expected message to pass the filter")
+			}
+		})
+	}
+}
+
+func TestAvroDecoder(t *testing.T) {
+	var requests int
+	srv := testRegistry(t, &requests)
+
+	d, err := NewAvroDecoder(SchemaRegistryConf{URL: srv.URL + "/"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		value := testAvroMessage(t, 42, map[string]interface{}{
+			"id":     int64(i),
+			"status": "paid",
+			"amount": 10.5,
+		})
+		decoded, err := d.Decode(value)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		data, _ := decoded.(map[string]interface{})
+		if data["id"] != int64(i) || data["status"] != "paid" || data["amount"] != 10.5 {
+			t.Fatalf("Unexpected data: %v", data)
+		}
+	}
+	if requests != 1 {
+		t.Fatalf("Expected schema to be fetched once, got %d requests", requests)
+	}
+
+	// Decoded messages are filtered as any other payload
+	f, err := NewFieldFilter(map[string]interface{}{
+		"status": "paid",
+		"amount": map[string]interface{}{"$gt": 10},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	value := testAvroMessage(t, 42, map[string]interface{}{
+		"id":     int64(1),
+		"status": "paid",
+		"amount": 10.5,
+	})
+	msg := Message{raw: value}
+	if err := msg.decode(d); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !f.Check(msg) {
+		t.Fatalf("Expected message to pass the filter")
+	}
+}
+
+func TestAvroDecoder_Error(t *testing.T) {
+	var requests int
+	srv := testRegistry(t, &requests)
+
+	d, err := NewAvroDecoder(SchemaRegistryConf{URL: srv.URL})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	testCases := []struct {
+		name  string
+		value []byte
+	}{
+		{
+			name:  "empty value",
+			value: nil,
+		},
+		{
+			name:  "no magic byte",
+			value: []byte(`{"id": 1}`),
+		},
+		{
+			name: "unknown schema",
+			value: testAvroMessage(t, 7, map[string]interface{}{
+				"id":     int64(1),
+				"status": "paid",
+				"amount": 10.5,
+			}),
+		},
+		{
+			name:  "invalid data",
+			value: []byte{0, 0, 0, 0, 42, 0xff},
+		},
+	}
+
+	for _, tt := range testCases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := d.Decode(tt.value); err == nil {
+				t.Fatalf("Expected error, got nil")
+			}
+		})
+	}
+}
+
+func TestAvroDecoder_Concurrent(t *testing.T) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		time.Sleep(50 * time.Millisecond)
+		if r.URL.Path != "/schemas/ids/42" {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"schema": testAvroSchema}) // nolint: errcheck,gosec
+	}))
+	t.Cleanup(srv.Close)
+
+	d, err := NewAvroDecoder(SchemaRegistryConf{URL: srv.URL})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	record := map[string]interface{}{"id": int64(1), "status": "paid", "amount": 10.5}
+
+	testCases := []struct {
+		name string
+		id   uint32
+		err  bool
+	}{
+		{name: "available schema", id: 42},
+		{name: "failed schema", id: 7, err: true},
+	}
+
+	for _, tt := range testCases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			atomic.StoreInt32(&requests, 0)
+			value := testAvroMessage(t, tt.id, record)
+
+			// Concurrent requests of the same schema are merged, and
+			// the failed one is not retried right away
+			errs := make(chan error, 10)
+			for i := 0; i < cap(errs); i++ {
+				go func() {
+					_, err := d.Decode(value)
+					errs <- err
+				}()
+			}
+			for i := 0; i < cap(errs); i++ {
+				if err := <-errs; (err != nil) != tt.err {
+					t.Fatalf("Expected error %v, got %v", tt.err, err)
+				}
+			}
+			if _, err := d.Decode(value); (err != nil) != tt.err {
+				t.Fatalf("Expected error %v, got %v", tt.err, err)
+			}
+			if n := atomic.LoadInt32(&requests); n != 1 {
+				t.Fatalf("Expected 1 request, got %d", n)
+			}
+		})
+	}
+}
+
+// testDescriptorSet writes a descriptor set with a single message
+// shop.Order to a temporary file.
+func testDescriptorSet(t *testing.T) string {
+	file := &descriptorpb.FileDescriptorProto{
+		Name:    proto.String("order.proto"),
+		Package: proto.String("shop"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{{
+			Name: proto.String("Order"),
+			Field: []*descriptorpb.FieldDescriptorProto{
+				{
+					Name:     proto.String("order_id"),
+					JsonName: proto.String("orderId"),
+					Number:   proto.Int32(1),
+					Type:     descriptorpb.FieldDescriptorProto_TYPE_INT32.Enum(),
+					Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+				},
+				{
+					Name:     proto.String("status"),
+					JsonName: proto.String("status"),
+					Number:   proto.Int32(2),
+					Type:     descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum(),
+					Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+				},
+			},
+		}},
+	}
+	b, err := proto.Marshal(&descriptorpb.FileDescriptorSet{
+		File: []*descriptorpb.FileDescriptorProto{file},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "order.pb")
+	if err := ioutil.WriteFile(path, b, 0o600); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return path
+}
+
+func TestProtobufDecoder(t *testing.T) {
+	d, err := NewProtobufDecoder(ProtobufConf{
+		DescriptorSet: testDescriptorSet(t),
+		Message:       "shop.Order",
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	msg := dynamicpb.NewMessage(d.desc)
+	fields := d.desc.Fields()
+	msg.Set(fields.ByName("order_id"), protoreflect.ValueOfInt32(42))
+	msg.Set(fields.ByName("status"), protoreflect.ValueOfString("paid"))
+	value, err := proto.Marshal(msg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	decoded, err := d.Decode(value)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	data, _ := decoded.(map[string]interface{})
+	if data["orderId"] != json.Number("42") || data["status"] != "paid" {
+		t.Fatalf("Unexpected data: %v", data)
+	}
+
+	if _, err := d.Decode([]byte(`{"order_id": 42}`)); err == nil {
+		t.Fatalf("Expected error, got nil")
+	}
+}
+
+func TestNewProtobufDecoder_Error(t *testing.T) {
+	path := testDescriptorSet(t)
+
+	testCases := []struct {
+		name string
+		conf ProtobufConf
+	}{
+		{
+			name: "no descriptor set",
+			conf: ProtobufConf{Message: "shop.Order"},
+		},
+		{
+			name: "no message",
+			conf: ProtobufConf{DescriptorSet: path},
+		},
+		{
+			name: "missing file",
+			conf: ProtobufConf{DescriptorSet: "/not/exists.pb", Message: "shop.Order"},
+		},
+		{
+			name: "unknown message",
+			conf: ProtobufConf{DescriptorSet: path, Message: "shop.Refund"},
+		},
+		{
+			name: "not a message",
+			conf: ProtobufConf{DescriptorSet: path, Message: "shop.Order.status"},
+		},
+	}
+
+	for _, tt := range testCases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewProtobufDecoder(tt.conf); err == nil {
+				t.Fatalf("Expected error, got nil")
+			}
+		})
+	}
+}
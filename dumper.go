@@ -2,40 +2,152 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
-// Dumper is a main app's entity. It run read-filter-save loop.
+// Policies of handling invalid messages.
+const (
+	InvalidSkip       = "skip"
+	InvalidFail       = "fail"
+	InvalidDeadLetter = "dead_letter"
+)
+
+const (
+	defaultFlushPeriod = time.Second
+	// flushBatch is a number of processed messages that are flushed
+	// without waiting for the flush period
+	flushBatch = 10000
+)
+
+// Dumper is a main app's entity. It run read-filter-save loop. Messages
+// are decoded and filtered by a pool of workers, and saved in the order
+// they have been read.
 type Dumper struct {
-	consumer  Consumer
-	filter    Filter
-	storage   Storage
-	logPeriod time.Duration
+	consumer   Consumer
+	decoder    Decoder
+	prefilter  RawFilter
+	filter     Filter
+	storage    Storage
+	workers    int
+	logPeriod  time.Duration
+	limits     Limits
+	invalid    string
+	deadLetter *DeadLetter
+
+	flushPeriod time.Duration
+	pending     []Message // processed messages that are not committed yet
+}
+
+// DumperConf is a set of dumper parameters.
+type DumperConf struct {
+	Decoder Decoder
+	// Prefilter is checked before messages are decoded, so the messages
+	// it drops are never decoded. Malformed payloads it detects are
+	// handled as invalid messages. Optional.
+	Prefilter RawFilter
+	// Workers is a number of workers that decode and filter messages,
+	// one by default.
+	Workers   int
+	LogPeriod time.Duration
+	// FlushPeriod is a period of flushing the storage and committing
+	// processed messages, one second by default.
+	FlushPeriod time.Duration
+	Limits      Limits
+	// Invalid is a policy of handling messages that cannot be decoded,
+	// skip by default.
+	Invalid string
+	// DeadLetter is a file for invalid messages, required for
+	// dead letter policy.
+	DeadLetter *DeadLetter
 }
 
 // NewDumper creates new dumper.
-func NewDumper(c Consumer, f Filter, s Storage, p time.Duration) *Dumper {
-	return &Dumper{consumer: c, filter: f, storage: s, logPeriod: p}
+func NewDumper(c Consumer, f Filter, s Storage, conf DumperConf) *Dumper {
+	if conf.Workers <= 0 {
+		conf.Workers = 1
+	}
+	if conf.Invalid == "" {
+		conf.Invalid = InvalidSkip
+	}
+	if conf.FlushPeriod <= 0 {
+		conf.FlushPeriod = defaultFlushPeriod
+	}
+	return &Dumper{
+		consumer:    c,
+		decoder:     conf.Decoder,
+		prefilter:   conf.Prefilter,
+		filter:      f,
+		storage:     s,
+		workers:     conf.Workers,
+		logPeriod:   conf.LogPeriod,
+		limits:      conf.Limits,
+		invalid:     conf.Invalid,
+		deadLetter:  conf.DeadLetter,
+		flushPeriod: conf.FlushPeriod,
+	}
 }
 
-// Run starts main read-filter-save loop and logs current state.
-func (d *Dumper) Run(ctx context.Context) error {
+// job is a message that is processed by workers. Jobs are queued in the
+// order of reading, done is closed when the message is processed.
+type job struct {
+	msg  Message
+	err  error
+	pass bool
+	done chan struct{}
+}
+
+// Run starts main read-filter-save loop and logs current state. It stops
+// when the context is canceled, the consumer has no more messages,
+// or one of the limits is reached. Messages are saved and committed
+// in the order of reading, and only after they have been saved, filtered
+// out or rejected. So commits never skip unprocessed messages. Saved
+// messages are committed in batches, after the storage is flushed.
+func (d *Dumper) Run(ctx context.Context) (err error) {
 	defer d.consumer.Close()
 	defer d.storage.Close()
+	if d.deadLetter != nil {
+		defer d.deadLetter.Close()
+	}
+	// Commit messages processed before the exit
+	defer func() {
+		if ferr := d.flush(ctx); ferr != nil && err == nil {
+			err = ferr
+		}
+	}()
+
+	// Stop reading and wait for workers on exit
+	ctx, cancel := context.WithCancel(ctx)
+
+	jobs := make(chan *job, d.workers)
+	queue := make(chan *job, 4*d.workers)
+	var wg sync.WaitGroup
+	wg.Add(d.workers)
+	for i := 0; i < d.workers; i++ {
+		go func() {
+			defer wg.Done()
+			d.work(jobs)
+		}()
+	}
+	go d.read(ctx, jobs, queue)
+	defer wg.Wait()
+	defer cancel()
 
-	var total, saved int
+	var total, saved, rejected int
 	var firstMsg, lastMsg time.Time
 	lastLog := time.Now()
 
 	logStats := func() {
 		log.Infof(
-			"Read messages from %s to %s (total %d, saved %d)",
+			"Read messages from %s to %s (total %d, saved %d, rejected %d)",
 			firstMsg.Local().Format("2006-01-02 15:04:05"),
 			lastMsg.Local().Format("2006-01-02 15:04:05"),
-			total, saved,
+			total, saved, rejected,
 		)
 		firstMsg = time.Time{}
 		lastMsg = time.Time{}
@@ -43,6 +155,9 @@ func (d *Dumper) Run(ctx context.Context) error {
 	}
 	defer logStats()
 
+	ticker := time.NewTicker(d.flushPeriod)
+	defer ticker.Stop()
+
 	for {
 		if ctx.Err() != nil {
 			return nil
@@ -52,10 +167,45 @@ func (d *Dumper) Run(ctx context.Context) error {
 			logStats()
 		}
 
-		msg, err := d.consumer.Read(ctx)
-		if err == context.Canceled {
+		if d.limitReached(total, saved) {
+			log.Info("Reached the limit of messages")
 			return nil
 		}
+
+		var j *job
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if err := d.flush(ctx); err != nil {
+				return err
+			}
+			continue
+		case j = <-queue:
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-j.done:
+		}
+
+		msg, err := j.msg, j.err
+		if err == io.EOF {
+			log.Info("Reached the end of the dump")
+			return nil
+		}
+		var invalid *InvalidMessageError
+		if errors.As(err, &invalid) {
+			total++
+			rejected++
+			if err := d.reject(invalid); err != nil {
+				return err
+			}
+			if err := d.commit(ctx, invalid.Message); err != nil {
+				return err
+			}
+			continue
+		}
 		if err != nil {
 			log.Errorf("Failed to read message: %v", err)
 			continue
@@ -69,7 +219,10 @@ func (d *Dumper) Run(ctx context.Context) error {
 			lastMsg = msg.time
 		}
 
-		if !d.filter.Check(msg) {
+		if !j.pass {
+			if err := d.commit(ctx, msg); err != nil {
+				return err
+			}
 			continue
 		}
 
@@ -77,5 +230,124 @@ func (d *Dumper) Run(ctx context.Context) error {
 			return fmt.Errorf("save message: %v", err)
 		}
 		saved++
+		if err := d.commit(ctx, msg); err != nil {
+			return err
+		}
+	}
+}
+
+// read reads messages from the consumer, and passes them both to workers
+// and to the queue of results. Read errors are passed to the queue as
+// processed jobs. It stops after the end of the messages, or when the
+// context is canceled.
+func (d *Dumper) read(ctx context.Context, jobs, queue chan<- *job) {
+	defer close(jobs)
+	for {
+		msg, err := d.consumer.Read(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		j := &job{msg: msg, err: err, done: make(chan struct{})}
+		if err != nil {
+			close(j.done)
+		}
+		select {
+		case queue <- j:
+		case <-ctx.Done():
+			return
+		}
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			continue
+		}
+		select {
+		case jobs <- j:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// work decodes and filters messages until the jobs channel is closed.
+// Messages dropped by the prefilter are not decoded.
+func (d *Dumper) work(jobs <-chan *job) {
+	for j := range jobs {
+		if d.prefilter != nil && j.msg.raw != nil {
+			ok, err := d.prefilter.CheckRaw(j.msg)
+			if err != nil {
+				j.err = &InvalidMessageError{Message: j.msg, Err: fmt.Errorf("invalid json: %v", err)}
+			}
+			if err != nil || !ok {
+				close(j.done)
+				continue
+			}
+		}
+		j.err = j.msg.decode(d.decoder)
+		if j.err == nil {
+			j.pass = d.filter.Check(j.msg)
+		}
+		close(j.done)
+	}
+}
+
+// commit adds a processed message to the batch of messages to commit,
+// the batch is flushed when it's full.
+func (d *Dumper) commit(ctx context.Context, msg Message) error {
+	d.pending = append(d.pending, msg)
+	if len(d.pending) < flushBatch {
+		return nil
+	}
+	return d.flush(ctx)
+}
+
+// flush flushes the storage and the dead letter file, and then commits
+// processed messages. The messages are committed even when the dump is
+// being stopped. Failed commits are not fatal, the messages are read
+// again on the next run.
+func (d *Dumper) flush(ctx context.Context) error {
+	if len(d.pending) == 0 {
+		return nil
+	}
+	if err := d.storage.Flush(); err != nil {
+		return fmt.Errorf("flush storage: %v", err)
+	}
+	if d.deadLetter != nil {
+		if err := d.deadLetter.Flush(); err != nil {
+			return fmt.Errorf("flush dead letter: %v", err)
+		}
+	}
+	if err := d.consumer.Commit(context.WithoutCancel(ctx), d.pending...); err != nil {
+		log.Errorf("Failed to commit messages: %v", err)
+	}
+	d.pending = d.pending[:0]
+	return nil
+}
+
+// reject handles a message that cannot be decoded according to the policy.
+func (d *Dumper) reject(e *InvalidMessageError) error {
+	switch d.invalid {
+	case InvalidFail:
+		return e
+	case InvalidDeadLetter:
+		log.Debugf("Rejected message: %v", e)
+		if err := d.deadLetter.Write(e); err != nil {
+			return fmt.Errorf("write to dead letter: %v", err)
+		}
+	default:
+		log.Debugf("Skipped message: %v", e)
+	}
+	return nil
+}
+
+// limitReached tells whether the dump should be stopped by the limits.
+func (d *Dumper) limitReached(total, saved int) bool {
+	if d.limits.MaxMessages > 0 && total >= d.limits.MaxMessages {
+		return true
+	}
+	if d.limits.MaxSaved > 0 && saved >= d.limits.MaxSaved {
+		return true
 	}
+	return false
 }
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// memConsumer is an in-memory consumer. Optional commit hook is called
+// before messages are committed.
+type memConsumer struct {
+	messages  []Message
+	committed []int64
+	commit    func([]Message)
+}
+
+func (c *memConsumer) Read(ctx context.Context) (Message, error) {
+	if len(c.messages) == 0 {
+		return Message{}, io.EOF
+	}
+	msg := c.messages[0]
+	c.messages = c.messages[1:]
+	return msg, nil
+}
+
+func (c *memConsumer) Commit(ctx context.Context, msgs ...Message) error {
+	if c.commit != nil {
+		c.commit(msgs)
+	}
+	for _, msg := range msgs {
+		c.committed = append(c.committed, msg.offset)
+	}
+	return nil
+}
+
+func (c *memConsumer) Close() {}
+
+// memStorage is an in-memory storage. Saved messages are buffered until
+// they are flushed. It fails to save messages with offsets listed in fail,
+// and to flush messages when failFlush is set.
+type memStorage struct {
+	messages  []Message
+	buffer    []Message
+	fail      map[int64]bool
+	failFlush bool
+}
+
+func (s *memStorage) Save(msg Message) error {
+	if s.fail[msg.offset] {
+		return errors.New("storage is unavailable")
+	}
+	s.buffer = append(s.buffer, msg)
+	return nil
+}
+
+func (s *memStorage) Flush() error {
+	if s.failFlush {
+		return errors.New("storage is unavailable")
+	}
+	s.messages = append(s.messages, s.buffer...)
+	s.buffer = nil
+	return nil
+}
+
+func (s *memStorage) Close() {}
+
+// testMessages creates messages with JSON payloads {"id": i, "even": bool}.
+// Messages with offsets listed in invalid get the raw payload from it.
+func testMessages(n int, invalid map[int64][]byte) []Message {
+	messages := make([]Message, n)
+	for i := range messages {
+		raw := []byte(fmt.Sprintf(`{"id": %d, "even": %t}`, i, i%2 == 0))
+		if v, ok := invalid[int64(i)]; ok {
+			raw = v
+		}
+		messages[i] = Message{
+			time:   time.Now(),
+			offset: int64(i),
+			raw:    raw,
+		}
+	}
+	return messages
+}
+
+func TestDumperRun(t *testing.T) {
+	f, err := NewFieldFilter(map[string]interface{}{"even": true})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	testCases := []struct {
+		name      string
+		limits    Limits
+		saved     int
+		committed int
+	}{
+		{
+			name:      "read till the end",
+			saved:     5,
+			committed: 10,
+		},
+		{
+			name:      "max messages",
+			limits:    Limits{MaxMessages: 4},
+			saved:     2,
+			committed: 4,
+		},
+		{
+			name:      "max saved",
+			limits:    Limits{MaxSaved: 3},
+			saved:     3,
+			committed: 5,
+		},
+	}
+
+	for _, tt := range testCases {
+		tt := tt
+		for _, workers := range []int{1, 4} {
+			workers := workers
+			t.Run(fmt.Sprintf("%s with %d workers", tt.name, workers), func(t *testing.T) {
+				c := &memConsumer{messages: testMessages(10, nil)}
+				s := &memStorage{}
+				d := NewDumper(c, f, s, DumperConf{
+					Decoder:   &JSONDecoder{},
+					Workers:   workers,
+					LogPeriod: time.Minute,
+					Limits:    tt.limits,
+				})
+				if err := d.Run(context.Background()); err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				if len(s.messages) != tt.saved {
+					t.Fatalf("Expected %d saved messages, got %d", tt.saved, len(s.messages))
+				}
+				if len(c.committed) != tt.committed {
+					t.Fatalf("Expected %d committed messages, got %d", tt.committed, len(c.committed))
+				}
+			})
+		}
+	}
+}
+
+func TestDumperRunOrder(t *testing.T) {
+	f, err := NewFieldFilter(nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	n := 1000
+	c := &memConsumer{messages: testMessages(n, nil)}
+	s := &memStorage{}
+	d := NewDumper(c, f, s, DumperConf{
+		Decoder:   &JSONDecoder{},
+		Workers:   8,
+		LogPeriod: time.Minute,
+	})
+	if err := d.Run(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(s.messages) != n {
+		t.Fatalf("Expected %d saved messages, got %d", n, len(s.messages))
+	}
+	for i, msg := range s.messages {
+		if msg.offset != int64(i) {
+			t.Fatalf("Expected offset %d, got %d", i, msg.offset)
+		}
+		if c.committed[i] != int64(i) {
+			t.Fatalf("Expected committed offset %d, got %d", i, c.committed[i])
+		}
+	}
+}
+
+func TestDumperRunPrefilter(t *testing.T) {
+	f, err := NewFieldFilter(map[string]interface{}{"even": true})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	c := &memConsumer{messages: testMessages(10, nil)}
+	s := &memStorage{}
+	d := NewDumper(c, f, s, DumperConf{
+		Decoder:   &JSONDecoder{},
+		Prefilter: f,
+		Workers:   4,
+		LogPeriod: time.Minute,
+	})
+	if err := d.Run(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(s.messages) != 5 {
+		t.Fatalf("Expected 5 saved messages, got %d", len(s.messages))
+	}
+	if len(c.committed) != 10 {
+		t.Fatalf("Expected 10 committed messages, got %d", len(c.committed))
+	}
+	for _, msg := range s.messages {
+		if msg.data == nil {
+			t.Fatalf("Expected saved message to be decoded")
+		}
+	}
+}
+
+func TestDumperRunPrefilterInvalid(t *testing.T) {
+	f, err := NewFieldFilter(map[string]interface{}{"even": true})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	invalid := map[int64][]byte{4: []byte(`{"id": 4, "even": tru}`)}
+
+	c := &memConsumer{messages: testMessages(10, invalid)}
+	s := &memStorage{}
+	d := NewDumper(c, f, s, DumperConf{
+		Decoder:   &JSONDecoder{},
+		Prefilter: f,
+		LogPeriod: time.Minute,
+		Invalid:   InvalidFail,
+	})
+	err = d.Run(context.Background())
+	var e *InvalidMessageError
+	if !errors.As(err, &e) {
+		t.Fatalf("Expected invalid message error, got %v", err)
+	}
+	if e.Message.offset != 4 {
+		t.Fatalf("Expected offset 4, got %d", e.Message.offset)
+	}
+}
+
+func TestDumperRunInvalid(t *testing.T) {
+	f, err := NewFieldFilter(nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	invalid := map[int64][]byte{2: nil, 5: []byte("{")}
+
+	t.Run("skip", func(t *testing.T) {
+		c := &memConsumer{messages: testMessages(10, invalid)}
+		s := &memStorage{}
+		d := NewDumper(c, f, s, DumperConf{Decoder: &JSONDecoder{}, LogPeriod: time.Minute})
+		if err := d.Run(context.Background()); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if len(s.messages) != 8 {
+			t.Fatalf("Expected 8 saved messages, got %d", len(s.messages))
+		}
+	})
+	t.Run("fail", func(t *testing.T) {
+		c := &memConsumer{messages: testMessages(10, invalid)}
+		s := &memStorage{}
+		d := NewDumper(c, f, s, DumperConf{
+			Decoder:   &JSONDecoder{},
+			LogPeriod: time.Minute,
+			Invalid:   InvalidFail,
+		})
+		err := d.Run(context.Background())
+		if !errors.Is(err, errTombstone) {
+			t.Fatalf("Expected %v, got %v", errTombstone, err)
+		}
+		if len(s.messages) != 2 {
+			t.Fatalf("Expected 2 saved messages, got %d", len(s.messages))
+		}
+	})
+	t.Run("dead letter", func(t *testing.T) {
+		file := filepath.Join(t.TempDir(), "dead.jsonl")
+		dl, err := NewDeadLetter(file)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		c := &memConsumer{messages: testMessages(10, invalid)}
+		s := &memStorage{}
+		d := NewDumper(c, f, s, DumperConf{
+			Decoder:    &JSONDecoder{},
+			LogPeriod:  time.Minute,
+			Invalid:    InvalidDeadLetter,
+			DeadLetter: dl,
+		})
+		if err := d.Run(context.Background()); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if len(s.messages) != 8 {
+			t.Fatalf("Expected 8 saved messages, got %d", len(s.messages))
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+		if len(lines) != 2 {
+			t.Fatalf("Expected 2 dead letters, got %d", len(lines))
+		}
+	})
+}
+
+func TestDumperRunCommit(t *testing.T) {
+	f, err := NewFieldFilter(map[string]interface{}{"even": true})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	c := &memConsumer{messages: testMessages(10, map[int64][]byte{1: nil})}
+	s := &memStorage{fail: map[int64]bool{6: true}}
+	d := NewDumper(c, f, s, DumperConf{
+		Decoder:   &JSONDecoder{},
+		Workers:   4,
+		LogPeriod: time.Minute,
+	})
+	if err := d.Run(context.Background()); err == nil {
+		t.Fatalf("Expected error, got nil")
+	}
+
+	// Message 6 failed to save, so it and the following messages
+	// must not be committed
+	want := []int64{0, 1, 2, 3, 4, 5}
+	if !reflect.DeepEqual(c.committed, want) {
+		t.Fatalf("Expected %v, got %v", want, c.committed)
+	}
+}
+
+func TestDumperRunFlush(t *testing.T) {
+	f, err := NewFieldFilter(map[string]interface{}{"even": true})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	t.Run("commit after flush", func(t *testing.T) {
+		// Slow consumer lets the flush period pass between messages
+		s := &memStorage{}
+		c := &slowConsumer{
+			memConsumer: memConsumer{messages: testMessages(10, nil)},
+			delay:       5 * time.Millisecond,
+		}
+		c.commit = func(msgs []Message) {
+			if len(s.buffer) > 0 {
+				t.Errorf("Expected flush before commit, got %d buffered messages", len(s.buffer))
+			}
+		}
+		d := NewDumper(c, f, s, DumperConf{
+			Decoder:     &JSONDecoder{},
+			LogPeriod:   time.Minute,
+			FlushPeriod: 10 * time.Millisecond,
+		})
+		if err := d.Run(context.Background()); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if len(s.messages) != 5 {
+			t.Fatalf("Expected 5 flushed messages, got %d", len(s.messages))
+		}
+		if len(c.committed) != 10 {
+			t.Fatalf("Expected 10 committed messages, got %d", len(c.committed))
+		}
+	})
+	t.Run("failed flush", func(t *testing.T) {
+		c := &memConsumer{messages: testMessages(10, nil)}
+		s := &memStorage{failFlush: true}
+		d := NewDumper(c, f, s, DumperConf{
+			Decoder:   &JSONDecoder{},
+			LogPeriod: time.Minute,
+		})
+		if err := d.Run(context.Background()); err == nil {
+			t.Fatalf("Expected error, got nil")
+		}
+		if len(c.committed) != 0 {
+			t.Fatalf("Expected no committed messages, got %v", c.committed)
+		}
+	})
+}
+
+// slowConsumer is an in-memory consumer that waits before each message.
+type slowConsumer struct {
+	memConsumer
+	delay time.Duration
+}
+
+func (c *slowConsumer) Read(ctx context.Context) (Message, error) {
+	time.Sleep(c.delay)
+	return c.memConsumer.Read(ctx)
+}
+
+// benchMessages creates messages with JSON payloads of about 1 KB.
+func benchMessages(n int) []Message {
+	padding := strings.Repeat("x", 1000)
+	messages := make([]Message, n)
+	for i := range messages {
+		messages[i] = Message{
+			time:   time.Now(),
+			offset: int64(i),
+			raw: []byte(fmt.Sprintf(
+				`{"id": %d, "type": "order", "amount": %d.5, "items": [{"sku": "A-%d", "qty": 2}], "note": "%s"}`,
+				i, i%5000, i, padding,
+			)),
+		}
+	}
+	return messages
+}
+
+func BenchmarkDumperRun(b *testing.B) {
+	f, err := NewFieldFilter(map[string]interface{}{
+		"type":         "order",
+		"amount":       map[string]interface{}{"$gt": 4950},
+		"items[0].sku": map[string]interface{}{"$regex": "^A-"},
+	})
+	if err != nil {
+		b.Fatalf("Unexpected error: %v", err)
+	}
+	messages := benchMessages(10000)
+
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers %d", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				c := &memConsumer{messages: messages}
+				d := NewDumper(c, f, &memStorage{}, DumperConf{
+					Decoder:   &JSONDecoder{},
+					Workers:   workers,
+					LogPeriod: time.Minute,
+				})
+				if err := d.Run(context.Background()); err != nil {
+					b.Fatalf("Unexpected error: %v", err)
+				}
+			}
+		})
+	}
+}
@@ -1,37 +1,637 @@
 package main
 
-import "strconv"
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/buger/jsonparser"
+)
 
 // Filter describes a way to decide whether a message should be saved or not.
 type Filter interface {
 	Check(Message) bool
 }
 
+// RawFilter is a filter that checks messages before their payloads are
+// decoded. It returns an error when the payload is malformed.
+type RawFilter interface {
+	CheckRaw(Message) (bool, error)
+}
+
+// MultiFilter is a filter that passes messages that pass all of its filters.
+type MultiFilter []Filter
+
+// Check decides whether a message should be saved or not.
+func (f MultiFilter) Check(msg Message) bool {
+	for _, filter := range f {
+		if !filter.Check(msg) {
+			return false
+		}
+	}
+	return true
+}
+
 // FieldFilter is a filter that makes a decision based on message's fields.
 type FieldFilter struct {
-	fields map[string]interface{}
+	cond   condition
+	fields []string
 }
 
-// NewFieldFilter creates new field filter.
-func NewFieldFilter(fields map[string]interface{}) *FieldFilter {
-	return &FieldFilter{fields: fields}
+// NewFieldFilter creates new field filter. Filter values are either plain
+// values, lists of values or objects with operators, e.g. {$gt: 1000}.
+// Conditions on different fields are combined with AND, other combinations
+// are made with $and, $or and $not clauses.
+func NewFieldFilter(fields map[string]interface{}) (*FieldFilter, error) {
+	cond, err := parseCondition(fields, "")
+	if err != nil {
+		return nil, err
+	}
+	return &FieldFilter{cond: cond, fields: fieldNames(cond, nil)}, nil
 }
 
 // Check decides whether a message should be saved or not.
 func (f *FieldFilter) Check(msg Message) bool {
-	for k, v := range f.fields {
-		data, ok := msg.data[k]
-		if !ok {
+	return f.cond.check(msg)
+}
+
+// CheckRaw decides whether a message should be saved before its JSON
+// payload is decoded. Only the fields used by the filter are extracted
+// from the payload. Returns an error when the payload is malformed,
+// though malformed parts that are not needed by the filter are not
+// always detected. Payloads with duplicate keys on the paths of the fields
+// are fully decoded, so the last values are used, as in decoded messages.
+func (f *FieldFilter) CheckRaw(msg Message) (bool, error) {
+	data := make(map[string]interface{}, len(f.fields))
+	for _, name := range f.fields {
+		switch {
+		case name == "$value":
+			var v interface{}
+			if err := unmarshalJSON(msg.raw, &v); err != nil {
+				return false, err
+			}
+			msg.value = v
+		case strings.HasPrefix(name, "$"):
+			// Kafka message attributes
+		default:
+			v, ok, err := lookupRaw(msg.raw, name)
+			if err == errDuplicateKey {
+				return f.checkDecoded(msg)
+			}
+			if err != nil {
+				return false, err
+			}
+			if ok {
+				data[name] = v
+			}
+		}
+	}
+	// Extracted values are found by their full paths, since top-level
+	// keys that match the whole path take precedence (see lookup)
+	msg.data = data
+	return f.cond.check(msg), nil
+}
+
+// checkDecoded decodes the whole JSON payload and checks the message.
+func (f *FieldFilter) checkDecoded(msg Message) (bool, error) {
+	var v interface{}
+	if err := unmarshalJSON(msg.raw, &v); err != nil {
+		return false, err
+	}
+	msg.value = v
+	msg.data, _ = v.(map[string]interface{})
+	return f.cond.check(msg), nil
+}
+
+// condition is a compiled part of a filter.
+type condition interface {
+	check(Message) bool
+}
+
+// allCondition is satisfied when all of its conditions are satisfied.
+type allCondition []condition
+
+func (c allCondition) check(msg Message) bool {
+	for _, cond := range c {
+		if !cond.check(msg) {
 			return false
 		}
-		if !equal(v, data) && !contain(v, data) {
+	}
+	return true
+}
+
+// anyCondition is satisfied when at least one of its conditions is satisfied.
+type anyCondition []condition
+
+func (c anyCondition) check(msg Message) bool {
+	for _, cond := range c {
+		if cond.check(msg) {
+			return true
+		}
+	}
+	return false
+}
+
+// notCondition is satisfied when its condition is not satisfied.
+type notCondition struct {
+	cond condition
+}
+
+func (c notCondition) check(msg Message) bool {
+	return !c.cond.check(msg)
+}
+
+// fieldCondition is a set of operators applied to a single field.
+type fieldCondition struct {
+	name  string
+	field field
+	ops   []operator
+}
+
+func (c fieldCondition) check(msg Message) bool {
+	val, exists := c.field(msg)
+	for _, op := range c.ops {
+		if !op(val, exists) {
 			return false
 		}
 	}
 	return true
 }
 
+// operator checks a field's value. The second argument tells whether
+// the field exists in the message.
+type operator func(val interface{}, exists bool) bool
+
+// parseCondition converts filter's object to a condition. Prefix is used
+// for error messages and points to the object in the whole filter.
+func parseCondition(obj map[string]interface{}, prefix string) (condition, error) {
+	cond := make(allCondition, 0, len(obj))
+	for k, v := range obj {
+		p := joinPath(prefix, k)
+		switch k {
+		case "$and", "$or":
+			list, err := parseConditionList(v, p)
+			if err != nil {
+				return nil, err
+			}
+			if k == "$and" {
+				cond = append(cond, allCondition(list))
+			} else {
+				cond = append(cond, anyCondition(list))
+			}
+		case "$not":
+			sub, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("%s: must be an object", p)
+			}
+			c, err := parseCondition(sub, p)
+			if err != nil {
+				return nil, err
+			}
+			cond = append(cond, notCondition{cond: c})
+		default:
+			f, ok := parseField(k)
+			if !ok {
+				return nil, fmt.Errorf("%s: unknown clause", p)
+			}
+			ops, err := parseOperators(v, p)
+			if err != nil {
+				return nil, err
+			}
+			cond = append(cond, fieldCondition{name: k, field: f, ops: ops})
+		}
+	}
+	return cond, nil
+}
+
+// fieldNames gets unique names of the fields used by the condition.
+func fieldNames(cond condition, names []string) []string {
+	switch c := cond.(type) {
+	case allCondition:
+		for _, sub := range c {
+			names = fieldNames(sub, names)
+		}
+	case anyCondition:
+		for _, sub := range c {
+			names = fieldNames(sub, names)
+		}
+	case notCondition:
+		names = fieldNames(c.cond, names)
+	case fieldCondition:
+		for _, name := range names {
+			if name == c.name {
+				return names
+			}
+		}
+		names = append(names, c.name)
+	}
+	return names
+}
+
+func parseConditionList(v interface{}, prefix string) ([]condition, error) {
+	list, ok := v.([]interface{})
+	if !ok || len(list) == 0 {
+		return nil, fmt.Errorf("%s: must be a non-empty list", prefix)
+	}
+	conds := make([]condition, len(list))
+	for i := range list {
+		p := fmt.Sprintf("%s[%d]", prefix, i)
+		obj, ok := list[i].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s: must be an object", p)
+		}
+		c, err := parseCondition(obj, p)
+		if err != nil {
+			return nil, err
+		}
+		conds[i] = c
+	}
+	return conds, nil
+}
+
+func joinPath(prefix, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return prefix + "." + key
+}
+
+// parseOperators converts a filter value to a list of operators. Objects
+// without operators are matched as values.
+func parseOperators(v interface{}, prefix string) ([]operator, error) {
+	obj, ok := v.(map[string]interface{})
+	if !ok {
+		return []operator{matchOperator(v)}, nil
+	}
+	switch countOperators(obj) {
+	case 0:
+		return []operator{matchOperator(v)}, nil
+	case len(obj):
+	default:
+		return nil, fmt.Errorf("%s: cannot mix operators and fields", prefix)
+	}
+
+	ops := make([]operator, 0, len(obj))
+	for name, arg := range obj {
+		if name == "$options" {
+			if _, ok := obj["$regex"]; !ok {
+				return nil, fmt.Errorf("%s: only allowed with $regex", joinPath(prefix, name))
+			}
+			continue
+		}
+		if name == "$regex" {
+			arg = regexArg{pattern: arg, options: obj["$options"]}
+		}
+		op, err := parseOperator(name, arg)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", joinPath(prefix, name), err)
+		}
+		ops = append(ops, op)
+	}
+	return ops, nil
+}
+
+// countOperators counts keys of the object that are operators.
+func countOperators(obj map[string]interface{}) int {
+	var n int
+	for k := range obj {
+		if strings.HasPrefix(k, "$") {
+			n++
+		}
+	}
+	return n
+}
+
+func parseOperator(name string, arg interface{}) (operator, error) {
+	switch name {
+	case "$eq":
+		return func(val interface{}, exists bool) bool {
+			return exists && equal(arg, val)
+		}, nil
+	case "$ne":
+		return func(val interface{}, exists bool) bool {
+			return !exists || !equal(arg, val)
+		}, nil
+	case "$gt":
+		return compareOperator(arg, func(c int) bool { return c > 0 })
+	case "$gte":
+		return compareOperator(arg, func(c int) bool { return c >= 0 })
+	case "$lt":
+		return compareOperator(arg, func(c int) bool { return c < 0 })
+	case "$lte":
+		return compareOperator(arg, func(c int) bool { return c <= 0 })
+	case "$in":
+		if _, ok := arg.([]interface{}); !ok {
+			return nil, fmt.Errorf("argument must be a list")
+		}
+		return func(val interface{}, exists bool) bool {
+			return exists && contain(arg, val)
+		}, nil
+	case "$nin":
+		if _, ok := arg.([]interface{}); !ok {
+			return nil, fmt.Errorf("argument must be a list")
+		}
+		return func(val interface{}, exists bool) bool {
+			return !exists || !contain(arg, val)
+		}, nil
+	case "$exists":
+		b, ok := toBool(arg)
+		if !ok {
+			return nil, fmt.Errorf("argument must be a boolean")
+		}
+		return func(_ interface{}, exists bool) bool {
+			return exists == b
+		}, nil
+	case "$regex":
+		re, err := compileRegex(arg.(regexArg))
+		if err != nil {
+			return nil, err
+		}
+		return func(val interface{}, exists bool) bool {
+			s, ok := toString(val)
+			return exists && ok && re.MatchString(s)
+		}, nil
+	case "$glob":
+		pattern, ok := toString(arg)
+		if !ok {
+			return nil, fmt.Errorf("argument must be a string")
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern: %v", err)
+		}
+		return func(val interface{}, exists bool) bool {
+			s, ok := toString(val)
+			if !exists || !ok {
+				return false
+			}
+			matched, _ := path.Match(pattern, s) // nolint: errcheck
+			return matched
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown operator")
+	}
+}
+
+// regexArg is an argument of $regex operator along with its $options.
+type regexArg struct {
+	pattern interface{}
+	options interface{}
+}
+
+// compileRegex compiles a regular expression. Options are the same as
+// in mongodb: i - case insensitive, m - multiline, s - dot matches newline.
+func compileRegex(arg regexArg) (*regexp.Regexp, error) {
+	pattern, ok := toString(arg.pattern)
+	if !ok {
+		return nil, fmt.Errorf("argument must be a string")
+	}
+	if arg.options != nil {
+		opts, ok := toString(arg.options)
+		if !ok {
+			return nil, fmt.Errorf("options must be a string")
+		}
+		for _, o := range opts {
+			if !strings.ContainsRune("ims", o) {
+				return nil, fmt.Errorf("unknown option %q", o)
+			}
+		}
+		if opts != "" {
+			pattern = "(?" + opts + ")" + pattern
+		}
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern: %v", err)
+	}
+	return re, nil
+}
+
+// matchOperator is the default operator: the field should be equal to
+// the value or to one of the values in the list.
+func matchOperator(v interface{}) operator {
+	return func(val interface{}, exists bool) bool {
+		return exists && (equal(v, val) || contain(v, val))
+	}
+}
+
+func compareOperator(arg interface{}, check func(int) bool) (operator, error) {
+	_, isNum := toFloat(arg)
+	_, isStr := toString(arg)
+	if !isNum && !isStr {
+		return nil, fmt.Errorf("argument must be a number or a string")
+	}
+	return func(val interface{}, exists bool) bool {
+		if !exists {
+			return false
+		}
+		c, ok := compare(val, arg)
+		return ok && check(c)
+	}, nil
+}
+
+// field extracts a value from a message. The second returned value tells
+// whether the field exists in the message.
+type field func(Message) (interface{}, bool)
+
+// parseField creates a field extractor by its name. Names starting with $
+// refer to kafka message attributes: $key, $topic, $partition, $offset,
+// $header.<name>, and $value - the whole decoded payload. Other names are
+// paths in the payload.
+func parseField(name string) (field, bool) {
+	switch name {
+	case "$key":
+		return func(msg Message) (interface{}, bool) {
+			return string(msg.key), msg.key != nil
+		}, true
+	case "$topic":
+		return func(msg Message) (interface{}, bool) {
+			return msg.topic, true
+		}, true
+	case "$partition":
+		return func(msg Message) (interface{}, bool) {
+			return msg.partition, true
+		}, true
+	case "$offset":
+		return func(msg Message) (interface{}, bool) {
+			return msg.offset, true
+		}, true
+	case "$value":
+		return func(msg Message) (interface{}, bool) {
+			return msg.value, msg.value != nil
+		}, true
+	}
+
+	if header := strings.TrimPrefix(name, "$header."); header != name {
+		return func(msg Message) (interface{}, bool) {
+			v, ok := msg.headers[header]
+			return v, ok
+		}, header != ""
+	}
+	if strings.HasPrefix(name, "$") {
+		return nil, false
+	}
+	return func(msg Message) (interface{}, bool) {
+		return lookup(msg.data, name)
+	}, true
+}
+
+// lookup finds a value in the data by its path. Path is a list of keys
+// separated by dots, keys may be followed by array indexes in square brackets,
+// e.g. "payload.user.id" or "items[0].sku". A top-level key that matches
+// the whole path takes precedence.
+func lookup(data map[string]interface{}, fieldPath string) (interface{}, bool) {
+	if v, ok := data[fieldPath]; ok {
+		return v, true
+	}
+
+	var cur interface{} = data
+	for _, part := range strings.Split(fieldPath, ".") {
+		key, indexes, ok := splitIndexes(part)
+		if !ok {
+			return nil, false
+		}
+		if key != "" {
+			m, ok := cur.(map[string]interface{})
+			if !ok {
+				return nil, false
+			}
+			if cur, ok = m[key]; !ok {
+				return nil, false
+			}
+		}
+		for _, i := range indexes {
+			arr, ok := cur.([]interface{})
+			if !ok || i < 0 || i >= len(arr) {
+				return nil, false
+			}
+			cur = arr[i]
+		}
+	}
+	return cur, true
+}
+
+// errDuplicateKey is returned when a JSON object has duplicate keys.
+var errDuplicateKey = errors.New("duplicate key")
+
+// lookupRaw finds a value by its path in a JSON object that has not been
+// decoded yet. Only the value is decoded, and the result is the same as
+// for lookup in the decoded object. Returns an error when the object or
+// the value is malformed, and errDuplicateKey when objects on the path have
+// duplicate keys, since the first value is found, but the last one is
+// decoded.
+func lookupRaw(raw []byte, fieldPath string) (interface{}, bool, error) {
+	keys := []string{fieldPath}
+	b, typ, _, err := jsonparser.Get(raw, fieldPath)
+	if typ == jsonparser.NotExist {
+		keys = nil
+		for _, part := range strings.Split(fieldPath, ".") {
+			key, indexes, ok := splitIndexes(part)
+			if !ok {
+				return nil, false, nil
+			}
+			if key != "" {
+				keys = append(keys, key)
+			}
+			for _, i := range indexes {
+				keys = append(keys, "["+strconv.Itoa(i)+"]")
+			}
+		}
+		b, typ, _, err = jsonparser.Get(raw, keys...)
+	}
+	if duplicateKey(raw, keys) {
+		return nil, false, errDuplicateKey
+	}
+	if err == jsonparser.KeyPathNotFoundError {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	switch typ {
+	case jsonparser.String:
+		s, err := jsonparser.ParseString(b)
+		return s, err == nil, err
+	case jsonparser.Number:
+		return json.Number(b), true, nil
+	case jsonparser.Boolean:
+		v, err := jsonparser.ParseBoolean(b)
+		return v, err == nil, err
+	case jsonparser.Null:
+		return nil, true, nil
+	case jsonparser.Object, jsonparser.Array:
+		var v interface{}
+		err := unmarshalJSON(b, &v)
+		return v, err == nil, err
+	default:
+		return nil, false, nil
+	}
+}
+
+// duplicateKey tells whether any of the objects on the path of keys has
+// duplicate keys of the path.
+func duplicateKey(raw []byte, keys []string) bool {
+	for _, key := range keys {
+		if !strings.HasPrefix(key, "[") {
+			var n int
+			jsonparser.ObjectEach(raw, func(k, _ []byte, _ jsonparser.ValueType, _ int) error { // nolint: errcheck,gosec
+				if string(k) == key {
+					n++
+				}
+				return nil
+			})
+			if n > 1 {
+				return true
+			}
+		}
+		v, _, _, err := jsonparser.Get(raw, key)
+		if err != nil {
+			return false
+		}
+		raw = v
+	}
+	return false
+}
+
+// splitIndexes splits a path part like "items[0][1]" into a key and
+// a list of array indexes.
+func splitIndexes(part string) (string, []int, bool) {
+	pos := strings.IndexByte(part, '[')
+	if pos < 0 {
+		return part, nil, part != ""
+	}
+	key, rest := part[:pos], part[pos:]
+
+	var indexes []int
+	for rest != "" {
+		end := strings.IndexByte(rest, ']')
+		if rest[0] != '[' || end < 0 {
+			return "", nil, false
+		}
+		i, err := strconv.Atoi(rest[1:end])
+		if err != nil {
+			return "", nil, false
+		}
+		indexes = append(indexes, i)
+		rest = rest[end+1:]
+	}
+	return key, indexes, true
+}
+
 func equal(a, b interface{}) bool {
+	// Integers are compared exactly, because large values lose
+	// precision when converted to floats
+	i1, ok1 := toInt(a)
+	i2, ok2 := toInt(b)
+	if ok1 && ok2 {
+		return i1 == i2
+	}
+
 	f1, ok1 := toFloat(a)
 	f2, ok2 := toFloat(b)
 	if ok1 && ok2 && f1 == f2 {
@@ -53,6 +653,44 @@ func equal(a, b interface{}) bool {
 	return false
 }
 
+// compare compares two values as numbers if both can be converted to numbers,
+// otherwise as strings. The result is -1 if a < b, 0 if a == b, and +1 if a > b.
+func compare(a, b interface{}) (int, bool) {
+	i1, ok1 := toInt(a)
+	i2, ok2 := toInt(b)
+	if ok1 && ok2 {
+		switch {
+		case i1 < i2:
+			return -1, true
+		case i1 > i2:
+			return 1, true
+		default:
+			return 0, true
+		}
+	}
+
+	f1, ok1 := toFloat(a)
+	f2, ok2 := toFloat(b)
+	if ok1 && ok2 {
+		switch {
+		case f1 < f2:
+			return -1, true
+		case f1 > f2:
+			return 1, true
+		default:
+			return 0, true
+		}
+	}
+
+	s1, ok1 := toString(a)
+	s2, ok2 := toString(b)
+	if ok1 && ok2 {
+		return strings.Compare(s1, s2), true
+	}
+
+	return 0, false
+}
+
 func contain(a, b interface{}) bool {
 	slice, ok := a.([]interface{})
 	if !ok {
@@ -67,6 +705,41 @@ func contain(a, b interface{}) bool {
 	return false
 }
 
+func toInt(val interface{}) (int64, bool) {
+	switch v := val.(type) {
+	case int:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	case uint:
+		if uint64(v) > math.MaxInt64 {
+			return 0, false
+		}
+		return int64(v), true
+	case uint32:
+		return int64(v), true
+	case uint64:
+		if v > math.MaxInt64 {
+			return 0, false
+		}
+		return int64(v), true
+	case json.Number:
+		if i, err := strconv.ParseInt(string(v), 10, 64); err == nil {
+			return i, true
+		}
+		return 0, false
+	case string:
+		if i, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return i, true
+		}
+		return 0, false
+	default:
+		return 0, false
+	}
+}
+
 func toFloat(val interface{}) (float64, bool) {
 	switch v := val.(type) {
 	case int:
@@ -85,6 +758,11 @@ func toFloat(val interface{}) (float64, bool) {
 		return float64(v), true
 	case float64:
 		return v, true
+	case json.Number:
+		if f, err := strconv.ParseFloat(string(v), 64); err == nil {
+			return f, true
+		}
+		return 0, false
 	case string:
 		if f, err := strconv.ParseFloat(v, 64); err == nil {
 			return f, true
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/ast"
+	"github.com/expr-lang/expr/vm"
+)
+
+// exprNumber is a function that converts payload values for expressions,
+// see numberPatcher.
+const exprNumber = "$number"
+
+// ExprFilter is a filter that makes a decision based on an expression,
+// e.g. `data.amount > 100 && kafka.partition == 3`.
+// See https://expr-lang.org for the language definition.
+type ExprFilter struct {
+	program *vm.Program
+}
+
+// exprEnv is a set of variables available in filter expressions.
+type exprEnv struct {
+	Data  map[string]interface{} `expr:"data"`
+	Value interface{}            `expr:"value"`
+	Kafka exprKafka              `expr:"kafka"`
+}
+
+// exprKafka is a set of kafka message attributes.
+type exprKafka struct {
+	Time      time.Time         `expr:"time"`
+	Topic     string            `expr:"topic"`
+	Partition int               `expr:"partition"`
+	Offset    int64             `expr:"offset"`
+	Key       string            `expr:"key"`
+	Headers   map[string]string `expr:"headers"`
+}
+
+// NewExprFilter compiles the expression and creates new expression filter.
+func NewExprFilter(code string) (*ExprFilter, error) {
+	program, err := expr.Compile(code,
+		expr.Env(exprEnv{}),
+		expr.AsBool(),
+		expr.Function(exprNumber, func(params ...interface{}) (interface{}, error) {
+			return exprValue(params[0]), nil
+		}, new(func(interface{}) interface{})),
+		expr.Patch(numberPatcher{}),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("compile expression: %v", err)
+	}
+	return &ExprFilter{program: program}, nil
+}
+
+// Check decides whether a message should be saved or not. Messages that
+// cause runtime errors, e.g. comparing a missing field with a number,
+// are not saved.
+func (f *ExprFilter) Check(msg Message) bool {
+	env := exprEnv{
+		Data:  msg.data,
+		Value: msg.value,
+		Kafka: exprKafka{
+			Time:      msg.time,
+			Topic:     msg.topic,
+			Partition: msg.partition,
+			Offset:    msg.offset,
+			Key:       string(msg.key),
+			Headers:   msg.headers,
+		},
+	}
+	out, err := expr.Run(f.program, env)
+	if err != nil {
+		return false
+	}
+	ok, _ := out.(bool)
+	return ok
+}
+
+// numberPatcher wraps payload values into exprNumber calls, so json.Number
+// values are converted only when an expression uses them, and the payload
+// itself is never copied. Payload values are reached by fields, closure
+// pointers (#) and builtins, e.g. values() or first().
+type numberPatcher struct{}
+
+func (numberPatcher) Visit(node *ast.Node) {
+	switch n := (*node).(type) {
+	case *ast.MemberNode, *ast.PointerNode, *ast.BuiltinNode:
+	case *ast.IdentifierNode:
+		if n.Value != "value" {
+			return
+		}
+	default:
+		return
+	}
+	// Kafka attributes have concrete types, payload values are interfaces
+	// or lists of interfaces
+	typ := (*node).Type()
+	if typ == nil {
+		return
+	}
+	switch typ.Kind() {
+	case reflect.Interface:
+	case reflect.Slice:
+		if typ.Elem().Kind() != reflect.Interface {
+			return
+		}
+	default:
+		return
+	}
+	ast.Patch(node, &ast.CallNode{
+		Callee:    &ast.IdentifierNode{Value: exprNumber},
+		Arguments: []ast.Node{*node},
+	})
+}
+
+// exprValue converts json.Number values to int64 or float64, since
+// expressions don't support json.Number. Lists are converted shallowly,
+// so builtins like sum() work, nested objects are converted on access.
+func exprValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		if f, err := v.Float64(); err == nil {
+			return f
+		}
+		return v.String()
+	case []interface{}:
+		var out []interface{}
+		for i, val := range v {
+			n, ok := val.(json.Number)
+			if !ok {
+				continue
+			}
+			if out == nil {
+				out = make([]interface{}, len(v))
+				copy(out, v)
+			}
+			out[i] = exprValue(n)
+		}
+		if out == nil {
+			return v
+		}
+		return out
+	default:
+		return v
+	}
+}
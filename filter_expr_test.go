@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestExprFilterCheck(t *testing.T) {
+	testCases := []struct {
+		name   string
+		msg    Message
+		code   string
+		result bool
+	}{
+		{
+			name: "satisfies comparison",
+			msg: Message{data: map[string]interface{}{
+				"amount": 150,
+			}},
+			code:   "data.amount > 100",
+			result: true,
+		},
+		{
+			name: "doesn't satisfy comparison",
+			msg: Message{data: map[string]interface{}{
+				"amount": 50,
+			}},
+			code:   "data.amount > 100",
+			result: false,
+		},
+		{
+			name: "satisfies complex expression",
+			msg: Message{data: map[string]interface{}{
+				"amount":   150.5,
+				"currency": "EUR",
+			}},
+			code:   `data.amount > 100 && data.currency in ["EUR", "USD"]`,
+			result: true,
+		},
+		{
+			name: "satisfies nested field",
+			msg: Message{data: map[string]interface{}{
+				"payload": map[string]interface{}{"type": "refund"},
+			}},
+			code:   `data.payload.type == "refund"`,
+			result: true,
+		},
+		{
+			name: "satisfies kafka time",
+			msg: Message{
+				time: time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC),
+				data: map[string]interface{}{},
+			},
+			code:   `kafka.time.Year() == 2024`,
+			result: true,
+		},
+		{
+			name: "satisfies kafka attributes",
+			msg: Message{
+				topic:     "orders",
+				partition: 3,
+				offset:    100,
+				key:       []byte("customer-1"),
+				headers:   map[string]string{"trace-id": "abc"},
+				data:      map[string]interface{}{},
+			},
+			code: `kafka.topic == "orders" && kafka.partition == 3 && ` +
+				`kafka.offset >= 100 && kafka.key == "customer-1" && ` +
+				`kafka.headers["trace-id"] == "abc"`,
+			result: true,
+		},
+		{
+			name: "satisfies json numbers",
+			msg: Message{data: map[string]interface{}{
+				"id":     json.Number("9007199254740993"),
+				"amount": json.Number("150.5"),
+			}},
+			code:   "data.id == 9007199254740993 && data.amount > 100",
+			result: true,
+		},
+		{
+			name: "satisfies nested json numbers",
+			msg: Message{data: map[string]interface{}{
+				"order": map[string]interface{}{
+					"items": []interface{}{
+						map[string]interface{}{"qty": json.Number("2")},
+					},
+					"prices": []interface{}{json.Number("1.5"), json.Number("2")},
+				},
+			}},
+			code:   "data.order.items[0].qty == 2 && sum(data.order.prices) == 3.5 && 2 in data.order.prices",
+			result: true,
+		},
+		{
+			name: "satisfies json number in predicate",
+			msg: Message{data: map[string]interface{}{
+				"items": []interface{}{
+					map[string]interface{}{"qty": json.Number("1")},
+					map[string]interface{}{"qty": json.Number("3")},
+				},
+			}},
+			code:   "any(data.items, .qty > 2)",
+			result: true,
+		},
+		{
+			name: "satisfies json number from builtins",
+			msg: Message{data: map[string]interface{}{
+				"nested": map[string]interface{}{"x": json.Number("5"), "y": json.Number("3")},
+				"items":  []interface{}{json.Number("1"), json.Number("3")},
+			}},
+			code: "any(values(data.nested), # == 5) && sum(values(data.nested)) == 8 && " +
+				"first(data.items) == 1 && last(filter(data.items, # > 1)) == 3",
+			result: true,
+		},
+		{
+			name: "satisfies optional json number",
+			msg: Message{data: map[string]interface{}{
+				"user": map[string]interface{}{"id": json.Number("7")},
+			}},
+			code:   "data?.user?.id == 7 && data?.order?.id == nil",
+			result: true,
+		},
+		{
+			name:   "satisfies json number value",
+			msg:    Message{value: json.Number("42")},
+			code:   "value == 42",
+			result: true,
+		},
+		{
+			name: "missing field is not saved",
+			msg: Message{data: map[string]interface{}{
+				"type": "foo",
+			}},
+			code:   "data.amount > 100",
+			result: false,
+		},
+	}
+
+	for _, tt := range testCases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := NewExprFilter(tt.code)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if result := f.Check(tt.msg); result != tt.result {
+				t.Fatalf("Expected %v, got %v", tt.result, result)
+			}
+		})
+	}
+}
+
+func TestExprValue(t *testing.T) {
+	testCases := []struct {
+		name string
+		in   interface{}
+		out  interface{}
+	}{
+		{
+			name: "integer",
+			in:   json.Number("9007199254740993"),
+			out:  int64(9007199254740993),
+		},
+		{
+			name: "float",
+			in:   json.Number("10.5"),
+			out:  float64(10.5),
+		},
+		{
+			name: "list",
+			in:   []interface{}{json.Number("1"), "two"},
+			out:  []interface{}{int64(1), "two"},
+		},
+		{
+			name: "object is not converted",
+			in:   map[string]interface{}{"id": json.Number("1")},
+			out:  map[string]interface{}{"id": json.Number("1")},
+		},
+		{
+			name: "string",
+			in:   "1",
+			out:  "1",
+		},
+	}
+
+	for _, tt := range testCases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			if out := exprValue(tt.in); !reflect.DeepEqual(out, tt.out) {
+				t.Fatalf("Expected %#v, got %#v", tt.out, out)
+			}
+		})
+	}
+
+	in := []interface{}{json.Number("1")}
+	exprValue(in)
+	if in[0] != json.Number("1") {
+		t.Fatalf("Input data was modified")
+	}
+}
+
+func TestNewExprFilter_Error(t *testing.T) {
+	testCases := []struct {
+		name string
+		code string
+	}{
+		{
+			name: "syntax error",
+			code: "data.amount >",
+		},
+		{
+			name: "not a boolean",
+			code: "len(data) + 1",
+		},
+		{
+			name: "unknown variable",
+			code: "payload.amount > 1",
+		},
+		{
+			name: "type mismatch",
+			code: `kafka.partition == "3"`,
+		},
+	}
+
+	for _, tt := range testCases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewExprFilter(tt.code); err == nil {
+				t.Fatalf("Expected error, got nil")
+			}
+		})
+	}
+}
+
+func TestMultiFilterCheck(t *testing.T) {
+	fields, err := NewFieldFilter(map[string]interface{}{"type": "refund"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	exp, err := NewExprFilter("data.amount > 100")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	f := MultiFilter{fields, exp}
+
+	msg := Message{data: map[string]interface{}{"type": "refund", "amount": 150}}
+	if !f.Check(msg) {
+		t.Fatalf("Expected true, got false")
+	}
+	msg = Message{data: map[string]interface{}{"type": "refund", "amount": 50}}
+	if f.Check(msg) {
+		t.Fatalf("Expected false, got true")
+	}
+	msg = Message{data: map[string]interface{}{"type": "payment", "amount": 150}}
+	if f.Check(msg) {
+		t.Fatalf("Expected false, got true")
+	}
+}
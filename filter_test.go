@@ -1,6 +1,12 @@
 package main
 
-import "testing"
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+)
 
 func TestCheck(t *testing.T) {
 	testCases := []struct {
@@ -90,14 +96,974 @@ func TestCheck(t *testing.T) {
 			},
 			result: false,
 		},
+		{
+			name: "contains correct nested field",
+			msg: Message{data: map[string]interface{}{
+				"type": "foo",
+				"payload": map[string]interface{}{
+					"user": map[string]interface{}{"id": 42},
+				},
+			}},
+			filter: map[string]interface{}{
+				"payload.user.id": 42,
+			},
+			result: true,
+		},
+		{
+			name: "contains nested field with wrong value",
+			msg: Message{data: map[string]interface{}{
+				"meta": map[string]interface{}{"source": "web"},
+			}},
+			filter: map[string]interface{}{
+				"meta.source": "mobile",
+			},
+			result: false,
+		},
+		{
+			name: "contains nested field with one of correct values",
+			msg: Message{data: map[string]interface{}{
+				"meta": map[string]interface{}{"source": "web"},
+			}},
+			filter: map[string]interface{}{
+				"meta.source": []interface{}{"mobile", "web"},
+			},
+			result: true,
+		},
+		{
+			name: "contains correct field in array",
+			msg: Message{data: map[string]interface{}{
+				"items": []interface{}{
+					map[string]interface{}{"sku": "A-1"},
+					map[string]interface{}{"sku": "B-2"},
+				},
+			}},
+			filter: map[string]interface{}{
+				"items[1].sku": "B-2",
+			},
+			result: true,
+		},
+		{
+			name: "array index out of range",
+			msg: Message{data: map[string]interface{}{
+				"items": []interface{}{
+					map[string]interface{}{"sku": "A-1"},
+				},
+			}},
+			filter: map[string]interface{}{
+				"items[1].sku": "A-1",
+			},
+			result: false,
+		},
+		{
+			name: "satisfies $gt",
+			msg: Message{data: map[string]interface{}{
+				"amount": 1500,
+			}},
+			filter: map[string]interface{}{
+				"amount": map[string]interface{}{"$gt": 1000},
+			},
+			result: true,
+		},
+		{
+			name: "satisfies $gt with numeric string",
+			msg: Message{data: map[string]interface{}{
+				"amount": "1500",
+			}},
+			filter: map[string]interface{}{
+				"amount": map[string]interface{}{"$gt": 1000},
+			},
+			result: true,
+		},
+		{
+			name: "doesn't satisfy $gt",
+			msg: Message{data: map[string]interface{}{
+				"amount": 1000,
+			}},
+			filter: map[string]interface{}{
+				"amount": map[string]interface{}{"$gt": 1000},
+			},
+			result: false,
+		},
+		{
+			name: "satisfies range",
+			msg: Message{data: map[string]interface{}{
+				"amount": 10.5,
+			}},
+			filter: map[string]interface{}{
+				"amount": map[string]interface{}{"$gte": 10, "$lt": 20},
+			},
+			result: true,
+		},
+		{
+			name: "doesn't satisfy range",
+			msg: Message{data: map[string]interface{}{
+				"amount": 20,
+			}},
+			filter: map[string]interface{}{
+				"amount": map[string]interface{}{"$gte": 10, "$lt": 20},
+			},
+			result: false,
+		},
+		{
+			name: "satisfies $lte with strings",
+			msg: Message{data: map[string]interface{}{
+				"date": "2024-05-01",
+			}},
+			filter: map[string]interface{}{
+				"date": map[string]interface{}{"$lte": "2024-05-02"},
+			},
+			result: true,
+		},
+		{
+			name: "$gt with not comparable value",
+			msg: Message{data: map[string]interface{}{
+				"amount": true,
+			}},
+			filter: map[string]interface{}{
+				"amount": map[string]interface{}{"$gt": 10},
+			},
+			result: false,
+		},
+		{
+			name: "satisfies $eq",
+			msg: Message{data: map[string]interface{}{
+				"status": "ok",
+			}},
+			filter: map[string]interface{}{
+				"status": map[string]interface{}{"$eq": "ok"},
+			},
+			result: true,
+		},
+		{
+			name: "satisfies $ne",
+			msg: Message{data: map[string]interface{}{
+				"status": "failed",
+			}},
+			filter: map[string]interface{}{
+				"status": map[string]interface{}{"$ne": "ok"},
+			},
+			result: true,
+		},
+		{
+			name: "doesn't satisfy $ne",
+			msg: Message{data: map[string]interface{}{
+				"status": "ok",
+			}},
+			filter: map[string]interface{}{
+				"status": map[string]interface{}{"$ne": "ok"},
+			},
+			result: false,
+		},
+		{
+			name: "satisfies $ne with missing field",
+			msg: Message{data: map[string]interface{}{
+				"type": "foo",
+			}},
+			filter: map[string]interface{}{
+				"status": map[string]interface{}{"$ne": "ok"},
+			},
+			result: true,
+		},
+		{
+			name: "satisfies $in",
+			msg: Message{data: map[string]interface{}{
+				"currency": "EUR",
+			}},
+			filter: map[string]interface{}{
+				"currency": map[string]interface{}{
+					"$in": []interface{}{"EUR", "USD"},
+				},
+			},
+			result: true,
+		},
+		{
+			name: "satisfies $nin",
+			msg: Message{data: map[string]interface{}{
+				"currency": "GBP",
+			}},
+			filter: map[string]interface{}{
+				"currency": map[string]interface{}{
+					"$nin": []interface{}{"EUR", "USD"},
+				},
+			},
+			result: true,
+		},
+		{
+			name: "doesn't satisfy $nin",
+			msg: Message{data: map[string]interface{}{
+				"currency": "USD",
+			}},
+			filter: map[string]interface{}{
+				"currency": map[string]interface{}{
+					"$nin": []interface{}{"EUR", "USD"},
+				},
+			},
+			result: false,
+		},
+		{
+			name: "satisfies $exists: false",
+			msg: Message{data: map[string]interface{}{
+				"type": "foo",
+			}},
+			filter: map[string]interface{}{
+				"error": map[string]interface{}{"$exists": false},
+			},
+			result: true,
+		},
+		{
+			name: "doesn't satisfy $exists: true",
+			msg: Message{data: map[string]interface{}{
+				"type": "foo",
+			}},
+			filter: map[string]interface{}{
+				"error": map[string]interface{}{"$exists": true},
+			},
+			result: false,
+		},
+		{
+			name: "satisfies nested field operator",
+			msg: Message{data: map[string]interface{}{
+				"payload": map[string]interface{}{"amount": 2000},
+			}},
+			filter: map[string]interface{}{
+				"payload.amount": map[string]interface{}{"$gt": 1000},
+			},
+			result: true,
+		},
+		{
+			name: "satisfies $or",
+			msg: Message{data: map[string]interface{}{
+				"type":   "payment",
+				"amount": 1500,
+			}},
+			filter: map[string]interface{}{
+				"$or": []interface{}{
+					map[string]interface{}{"type": "refund"},
+					map[string]interface{}{
+						"amount": map[string]interface{}{"$gt": 1000},
+					},
+				},
+			},
+			result: true,
+		},
+		{
+			name: "doesn't satisfy $or",
+			msg: Message{data: map[string]interface{}{
+				"type":   "payment",
+				"amount": 500,
+			}},
+			filter: map[string]interface{}{
+				"$or": []interface{}{
+					map[string]interface{}{"type": "refund"},
+					map[string]interface{}{
+						"amount": map[string]interface{}{"$gt": 1000},
+					},
+				},
+			},
+			result: false,
+		},
+		{
+			name: "satisfies $and",
+			msg: Message{data: map[string]interface{}{
+				"amount": 1500,
+			}},
+			filter: map[string]interface{}{
+				"$and": []interface{}{
+					map[string]interface{}{
+						"amount": map[string]interface{}{"$gt": 1000},
+					},
+					map[string]interface{}{
+						"amount": map[string]interface{}{"$lt": 2000},
+					},
+				},
+			},
+			result: true,
+		},
+		{
+			name: "satisfies $not",
+			msg: Message{data: map[string]interface{}{
+				"type": "payment",
+			}},
+			filter: map[string]interface{}{
+				"$not": map[string]interface{}{"type": "refund"},
+			},
+			result: true,
+		},
+		{
+			name: "doesn't satisfy $not",
+			msg: Message{data: map[string]interface{}{
+				"type": "refund",
+			}},
+			filter: map[string]interface{}{
+				"$not": map[string]interface{}{"type": "refund"},
+			},
+			result: false,
+		},
+		{
+			name: "satisfies nested combinators",
+			msg: Message{data: map[string]interface{}{
+				"type":     "refund",
+				"currency": "EUR",
+			}},
+			filter: map[string]interface{}{
+				"currency": "EUR",
+				"$or": []interface{}{
+					map[string]interface{}{
+						"$and": []interface{}{
+							map[string]interface{}{"type": "refund"},
+							map[string]interface{}{
+								"$not": map[string]interface{}{
+									"status": "failed",
+								},
+							},
+						},
+					},
+					map[string]interface{}{
+						"amount": map[string]interface{}{"$gt": 1000},
+					},
+				},
+			},
+			result: true,
+		},
+		{
+			name: "doesn't satisfy combinators and field",
+			msg: Message{data: map[string]interface{}{
+				"type":     "refund",
+				"currency": "USD",
+			}},
+			filter: map[string]interface{}{
+				"currency": "EUR",
+				"$or": []interface{}{
+					map[string]interface{}{"type": "refund"},
+				},
+			},
+			result: false,
+		},
+		{
+			name: "satisfies $regex",
+			msg: Message{data: map[string]interface{}{
+				"user_agent": "curl/8.4.0",
+			}},
+			filter: map[string]interface{}{
+				"user_agent": map[string]interface{}{"$regex": "curl"},
+			},
+			result: true,
+		},
+		{
+			name: "doesn't satisfy case-sensitive $regex",
+			msg: Message{data: map[string]interface{}{
+				"user_agent": "Curl/8.4.0",
+			}},
+			filter: map[string]interface{}{
+				"user_agent": map[string]interface{}{"$regex": "^curl/"},
+			},
+			result: false,
+		},
+		{
+			name: "satisfies case-insensitive $regex",
+			msg: Message{data: map[string]interface{}{
+				"user_agent": "Curl/8.4.0",
+			}},
+			filter: map[string]interface{}{
+				"user_agent": map[string]interface{}{
+					"$regex":   "^curl/",
+					"$options": "i",
+				},
+			},
+			result: true,
+		},
+		{
+			name: "$regex with not a string",
+			msg: Message{data: map[string]interface{}{
+				"code": 200,
+			}},
+			filter: map[string]interface{}{
+				"code": map[string]interface{}{"$regex": "200"},
+			},
+			result: false,
+		},
+		{
+			name: "satisfies $glob",
+			msg: Message{data: map[string]interface{}{
+				"path": "/api/v2/orders/123",
+			}},
+			filter: map[string]interface{}{
+				"path": map[string]interface{}{"$glob": "/api/v2/orders/*"},
+			},
+			result: true,
+		},
+		{
+			name: "doesn't satisfy $glob",
+			msg: Message{data: map[string]interface{}{
+				"path": "/api/v2/orders/123/items",
+			}},
+			filter: map[string]interface{}{
+				"path": map[string]interface{}{"$glob": "/api/v2/orders/*"},
+			},
+			result: false,
+		},
+		{
+			name: "satisfies kafka key",
+			msg: Message{
+				key:  []byte("customer-1"),
+				data: map[string]interface{}{"type": "foo"},
+			},
+			filter: map[string]interface{}{
+				"$key": "customer-1",
+				"type": "foo",
+			},
+			result: true,
+		},
+		{
+			name: "doesn't satisfy missing kafka key",
+			msg: Message{
+				data: map[string]interface{}{"type": "foo"},
+			},
+			filter: map[string]interface{}{
+				"$key": map[string]interface{}{"$exists": true},
+			},
+			result: false,
+		},
+		{
+			name: "satisfies kafka header",
+			msg: Message{
+				headers: map[string]string{"trace-id": "abc"},
+				data:    map[string]interface{}{},
+			},
+			filter: map[string]interface{}{
+				"$header.trace-id": "abc",
+			},
+			result: true,
+		},
+		{
+			name: "doesn't satisfy missing kafka header",
+			msg: Message{
+				data: map[string]interface{}{},
+			},
+			filter: map[string]interface{}{
+				"$header.trace-id": "abc",
+			},
+			result: false,
+		},
+		{
+			name: "satisfies kafka partition and offset",
+			msg: Message{
+				partition: 3,
+				offset:    1000,
+				data:      map[string]interface{}{},
+			},
+			filter: map[string]interface{}{
+				"$partition": []interface{}{1, 3},
+				"$offset":    map[string]interface{}{"$gte": 1000},
+			},
+			result: true,
+		},
+		{
+			name: "satisfies kafka topic",
+			msg: Message{
+				topic: "orders",
+				data:  map[string]interface{}{},
+			},
+			filter: map[string]interface{}{
+				"$topic": "orders",
+			},
+			result: true,
+		},
+		{
+			name: "nested field is missing",
+			msg: Message{data: map[string]interface{}{
+				"payload": map[string]interface{}{"type": "foo"},
+			}},
+			filter: map[string]interface{}{
+				"payload.user.id": 42,
+			},
+			result: false,
+		},
+	}
+
+	for _, tt := range testCases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := NewFieldFilter(tt.filter)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if result := f.Check(tt.msg); result != tt.result {
+				t.Fatalf("Expected %v, got %v", tt.result, result)
+			}
+		})
+	}
+}
+
+func TestNewFieldFilter_Error(t *testing.T) {
+	testCases := []struct {
+		name   string
+		filter map[string]interface{}
+		err    string
+	}{
+		{
+			name: "unknown operator",
+			filter: map[string]interface{}{
+				"amount": map[string]interface{}{"$foo": 10},
+			},
+			err: "amount.$foo: unknown operator",
+		},
+		{
+			name: "operators and fields",
+			filter: map[string]interface{}{
+				"amount": map[string]interface{}{"$gt": 1, "b": 2},
+			},
+			err: "amount: cannot mix operators and fields",
+		},
+		{
+			name: "invalid $in argument",
+			filter: map[string]interface{}{
+				"amount": map[string]interface{}{"$in": 10},
+			},
+			err: "amount.$in: argument must be a list",
+		},
+		{
+			name: "invalid $exists argument",
+			filter: map[string]interface{}{
+				"amount": map[string]interface{}{"$exists": "yes"},
+			},
+			err: "amount.$exists: argument must be a boolean",
+		},
+		{
+			name: "invalid $gt argument",
+			filter: map[string]interface{}{
+				"amount": map[string]interface{}{"$gt": []interface{}{1}},
+			},
+			err: "amount.$gt: argument must be a number or a string",
+		},
+		{
+			name: "invalid $regex",
+			filter: map[string]interface{}{
+				"ua": map[string]interface{}{"$regex": "curl("},
+			},
+			err: "ua.$regex: invalid pattern: error parsing regexp: " +
+				"missing closing ): `curl(`",
+		},
+		{
+			name: "invalid $regex options",
+			filter: map[string]interface{}{
+				"ua": map[string]interface{}{"$regex": "curl", "$options": "x"},
+			},
+			err: "ua.$regex: unknown option 'x'",
+		},
+		{
+			name: "$options without $regex",
+			filter: map[string]interface{}{
+				"ua": map[string]interface{}{"$options": "i"},
+			},
+			err: "ua.$options: only allowed with $regex",
+		},
+		{
+			name: "invalid $glob",
+			filter: map[string]interface{}{
+				"path": map[string]interface{}{"$glob": "/api/[a-"},
+			},
+			err: "path.$glob: invalid pattern: syntax error in pattern",
+		},
+		{
+			name: "unknown clause",
+			filter: map[string]interface{}{
+				"$xor": []interface{}{},
+			},
+			err: "$xor: unknown clause",
+		},
+		{
+			name: "empty header name",
+			filter: map[string]interface{}{
+				"$header.": "abc",
+			},
+			err: "$header.: unknown clause",
+		},
+		{
+			name: "$or is not a list",
+			filter: map[string]interface{}{
+				"$or": map[string]interface{}{"type": "foo"},
+			},
+			err: "$or: must be a non-empty list",
+		},
+		{
+			name: "$and is empty",
+			filter: map[string]interface{}{
+				"$and": []interface{}{},
+			},
+			err: "$and: must be a non-empty list",
+		},
+		{
+			name: "$or element is not an object",
+			filter: map[string]interface{}{
+				"$or": []interface{}{
+					map[string]interface{}{"type": "foo"},
+					"bar",
+				},
+			},
+			err: "$or[1]: must be an object",
+		},
+		{
+			name: "$not is not an object",
+			filter: map[string]interface{}{
+				"$not": []interface{}{},
+			},
+			err: "$not: must be an object",
+		},
+		{
+			name: "nested error",
+			filter: map[string]interface{}{
+				"$or": []interface{}{
+					map[string]interface{}{"type": "foo"},
+					map[string]interface{}{
+						"$not": map[string]interface{}{
+							"amount": map[string]interface{}{"$in": 10},
+						},
+					},
+				},
+			},
+			err: "$or[1].$not.amount.$in: argument must be a list",
+		},
 	}
 
 	for _, tt := range testCases {
 		tt := tt
 		t.Run(tt.name, func(t *testing.T) {
-			f := NewFieldFilter(tt.filter)
-			if result := f.Check(tt.msg); result != tt.result {
-				t.Fatalf("Expected %v, got %v", tt.result, result)
+			_, err := NewFieldFilter(tt.filter)
+			if err == nil {
+				t.Fatalf("Expected error, got nil")
+			}
+			if err.Error() != tt.err {
+				t.Fatalf("Expected %q, got %q", tt.err, err.Error())
+			}
+		})
+	}
+}
+
+func TestLookup(t *testing.T) {
+	data := map[string]interface{}{
+		"type":     "foo",
+		"meta.raw": true,
+		"payload": map[string]interface{}{
+			"user": map[string]interface{}{"id": 42},
+		},
+		"items": []interface{}{
+			map[string]interface{}{"sku": "A-1"},
+			map[string]interface{}{"sku": "B-2"},
+		},
+		"matrix": []interface{}{
+			[]interface{}{1, 2},
+			[]interface{}{3, 4},
+		},
+	}
+
+	testCases := []struct {
+		name string
+		path string
+		out  interface{}
+		ok   bool
+	}{
+		{
+			name: "top-level key",
+			path: "type",
+			out:  "foo",
+			ok:   true,
+		},
+		{
+			name: "top-level key with dot",
+			path: "meta.raw",
+			out:  true,
+			ok:   true,
+		},
+		{
+			name: "nested key",
+			path: "payload.user.id",
+			out:  42,
+			ok:   true,
+		},
+		{
+			name: "array element",
+			path: "items[1].sku",
+			out:  "B-2",
+			ok:   true,
+		},
+		{
+			name: "nested arrays",
+			path: "matrix[1][0]",
+			out:  3,
+			ok:   true,
+		},
+		{
+			name: "missing key",
+			path: "payload.user.name",
+			ok:   false,
+		},
+		{
+			name: "index out of range",
+			path: "items[2].sku",
+			ok:   false,
+		},
+		{
+			name: "index of not an array",
+			path: "payload[0]",
+			ok:   false,
+		},
+		{
+			name: "key of not an object",
+			path: "type.name",
+			ok:   false,
+		},
+		{
+			name: "invalid index",
+			path: "items[x].sku",
+			ok:   false,
+		},
+		{
+			name: "empty key",
+			path: "payload..id",
+			ok:   false,
+		},
+	}
+
+	for _, tt := range testCases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			out, ok := lookup(data, tt.path)
+			if ok != tt.ok {
+				t.Fatalf("Expected %v, got %v", tt.ok, ok)
+			}
+			if out != tt.out {
+				t.Fatalf("Expected %v, got %v", tt.out, out)
+			}
+		})
+	}
+}
+
+func TestLookupRaw(t *testing.T) {
+	raw := []byte(`{
+		"type": "f\u006fo",
+		"meta.raw": true,
+		"amount": 9007199254740993,
+		"deleted": null,
+		"payload": {"user": {"id": 42, "tags": ["a", "b"]}},
+		"items": [{"sku": "A-1"}, {"sku": "B-2"}],
+		"matrix": [[1, 2], [3, 4]]
+	}`)
+	var data map[string]interface{}
+	if err := unmarshalJSON(raw, &data); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	paths := []string{
+		"type",
+		"meta.raw",
+		"amount",
+		"deleted",
+		"payload",
+		"payload.user.id",
+		"payload.user.tags",
+		"items[1].sku",
+		"matrix[1][0]",
+		"payload.user.name",
+		"items[2].sku",
+		"items[-1].sku",
+		"payload[0]",
+		"type.name",
+		"items[x].sku",
+		"payload..id",
+	}
+	for _, p := range paths {
+		p := p
+		t.Run(p, func(t *testing.T) {
+			want, wantOK := lookup(data, p)
+			got, gotOK, err := lookupRaw(raw, p)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if gotOK != wantOK {
+				t.Fatalf("Expected %v, got %v", wantOK, gotOK)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("Expected %#v, got %#v", want, got)
+			}
+		})
+	}
+}
+
+func TestCheck_Raw(t *testing.T) {
+	raw := []byte(`{"type": "refund", "amount": 1500, "user": {"id": 7}, "items": [{"sku": "A-1"}]}`)
+	decoded := Message{raw: raw}
+	if err := decoded.decode(&JSONDecoder{}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	filters := []map[string]interface{}{
+		{"type": "refund"},
+		{"type": "payment"},
+		{"amount": map[string]interface{}{"$gt": 1000}},
+		{"amount": []interface{}{1500, 2000}},
+		{"user.id": 7, "items[0].sku": map[string]interface{}{"$regex": "^A-"}},
+		{"user.name": map[string]interface{}{"$exists": false}},
+		{"$value": map[string]interface{}{"$exists": true}},
+		{"$or": []interface{}{
+			map[string]interface{}{"type": "payment"},
+			map[string]interface{}{"items[0].sku": map[string]interface{}{"$glob": "A-*"}},
+		}},
+	}
+	for i, filter := range filters {
+		f, err := NewFieldFilter(filter)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		want := f.Check(decoded)
+		got, err := f.CheckRaw(Message{raw: raw})
+		if err != nil {
+			t.Fatalf("Filter #%d: unexpected error: %v", i, err)
+		}
+		if got != want {
+			t.Fatalf("Filter #%d: expected %v, got %v", i, want, got)
+		}
+	}
+}
+
+func TestCheckRaw_DuplicateKeys(t *testing.T) {
+	testCases := []struct {
+		name   string
+		filter map[string]interface{}
+		raw    string
+	}{
+		{
+			name:   "top-level key",
+			filter: map[string]interface{}{"a": 1},
+			raw:    `{"a": 2, "a": 1}`,
+		},
+		{
+			name:   "nested key",
+			filter: map[string]interface{}{"user.id": 2},
+			raw:    `{"user": {"id": 1, "id": 2}}`,
+		},
+		{
+			name:   "parent object",
+			filter: map[string]interface{}{"user.id": map[string]interface{}{"$exists": false}},
+			raw:    `{"user": {"id": 1}, "user": {"name": "alice"}}`,
+		},
+		{
+			name:   "literal key with dots",
+			filter: map[string]interface{}{"meta.raw": true},
+			raw:    `{"meta.raw": false, "meta.raw": true}`,
+		},
+	}
+
+	for _, tt := range testCases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := NewFieldFilter(tt.filter)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			// Decoded JSON gets the last values of duplicate keys
+			decoded := Message{raw: []byte(tt.raw)}
+			if err := decoded.decode(&JSONDecoder{}); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !f.Check(decoded) {
+				t.Fatalf("Expected decoded message to pass")
+			}
+			ok, err := f.CheckRaw(Message{raw: []byte(tt.raw)})
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !ok {
+				t.Fatalf("Expected raw message to pass")
+			}
+		})
+	}
+}
+
+func TestCheckRaw_Malformed(t *testing.T) {
+	testCases := []struct {
+		name   string
+		filter map[string]interface{}
+		raw    string
+	}{
+		{
+			name:   "broken string",
+			filter: map[string]interface{}{"type": "refund"},
+			raw:    `{"type": "ref`,
+		},
+		{
+			name:   "broken nested object",
+			filter: map[string]interface{}{"user": map[string]interface{}{"$exists": true}},
+			raw:    `{"user": {"id": 7, "name": }}`,
+		},
+		{
+			name:   "broken value",
+			filter: map[string]interface{}{"$value": map[string]interface{}{"$exists": true}},
+			raw:    `{"type": "refund"`,
+		},
+	}
+
+	for _, tt := range testCases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := NewFieldFilter(tt.filter)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if _, err := f.CheckRaw(Message{raw: []byte(tt.raw)}); err == nil {
+				t.Fatalf("Expected error, got nil")
+			}
+		})
+	}
+}
+
+// benchPayload creates a JSON object of about the given size with
+// the fields used by the filter at the end.
+func benchPayload(size int) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(`{"id": "0b7e4a52", "items": [`)
+	for i := 0; buf.Len() < size; i++ {
+		if i > 0 {
+			buf.WriteString(",")
+		}
+		fmt.Fprintf(&buf,
+			`{"sku": "SKU-%d", "name": "Item number %d", "qty": %d, "price": %d.99, "tags": ["red", "large"]}`,
+			i, i, i%5+1, i%100,
+		)
+	}
+	buf.WriteString(`], "type": "order", "payload": {"user": {"id": 42}}}`)
+	return buf.Bytes()
+}
+
+func BenchmarkFieldFilter(b *testing.B) {
+	f, err := NewFieldFilter(map[string]interface{}{
+		"type":            "refund",
+		"payload.user.id": 42,
+	})
+	if err != nil {
+		b.Fatalf("Unexpected error: %v", err)
+	}
+
+	for _, size := range []int{5 << 10, 20 << 10, 50 << 10} {
+		raw := benchPayload(size)
+		b.Run(fmt.Sprintf("decode %dKB", size>>10), func(b *testing.B) {
+			b.SetBytes(int64(len(raw)))
+			for i := 0; i < b.N; i++ {
+				msg := Message{raw: raw}
+				if err := msg.decode(&JSONDecoder{}); err != nil {
+					b.Fatalf("Unexpected error: %v", err)
+				}
+				if f.Check(msg) {
+					b.Fatalf("Expected message to be dropped")
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("lazy %dKB", size>>10), func(b *testing.B) {
+			b.SetBytes(int64(len(raw)))
+			for i := 0; i < b.N; i++ {
+				if ok, _ := f.CheckRaw(Message{raw: raw}); ok {
+					b.Fatalf("Expected message to be dropped")
+				}
 			}
 		})
 	}
@@ -152,6 +1118,30 @@ func TestEqual(t *testing.T) {
 			in2:    "world",
 			result: false,
 		},
+		{
+			name:   "large int, json number => equal",
+			in1:    int64(1234567890123456789),
+			in2:    json.Number("1234567890123456789"),
+			result: true,
+		},
+		{
+			name:   "large int, json number => not equal",
+			in1:    int64(1234567890123456789),
+			in2:    json.Number("1234567890123456788"),
+			result: false,
+		},
+		{
+			name:   "large int, string => not equal",
+			in1:    int64(9007199254740993),
+			in2:    "9007199254740992",
+			result: false,
+		},
+		{
+			name:   "int, json number float => equal",
+			in1:    int(10),
+			in2:    json.Number("10.0"),
+			result: true,
+		},
 	}
 
 	for _, tt := range testCases {
@@ -164,6 +1154,86 @@ func TestEqual(t *testing.T) {
 	}
 }
 
+func TestCompare(t *testing.T) {
+	testCases := []struct {
+		name   string
+		in1    interface{}
+		in2    interface{}
+		result int
+		ok     bool
+	}{
+		{
+			name:   "int, int => less",
+			in1:    int(10),
+			in2:    int(20),
+			result: -1,
+			ok:     true,
+		},
+		{
+			name:   "float, int => greater",
+			in1:    float64(20.5),
+			in2:    int(20),
+			result: 1,
+			ok:     true,
+		},
+		{
+			name:   "numeric string, int => equal",
+			in1:    "20",
+			in2:    int(20),
+			result: 0,
+			ok:     true,
+		},
+		{
+			name:   "numeric strings => compared as numbers",
+			in1:    "9",
+			in2:    "10",
+			result: -1,
+			ok:     true,
+		},
+		{
+			name:   "strings => compared as strings",
+			in1:    "b",
+			in2:    "a",
+			result: 1,
+			ok:     true,
+		},
+		{
+			name:   "string, int => invalid",
+			in1:    "hello",
+			in2:    int(10),
+			result: 0,
+			ok:     false,
+		},
+		{
+			name:   "large ints => compared exactly",
+			in1:    json.Number("9007199254740993"),
+			in2:    int64(9007199254740992),
+			result: 1,
+			ok:     true,
+		},
+		{
+			name:   "bool, bool => invalid",
+			in1:    true,
+			in2:    false,
+			result: 0,
+			ok:     false,
+		},
+	}
+
+	for _, tt := range testCases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			result, ok := compare(tt.in1, tt.in2)
+			if ok != tt.ok {
+				t.Fatalf("Expected %v, got %v", tt.ok, ok)
+			}
+			if result != tt.result {
+				t.Fatalf("Expected %v, got %v", tt.result, result)
+			}
+		})
+	}
+}
+
 func TestContain(t *testing.T) {
 	testCases := []struct {
 		name    string
@@ -237,6 +1307,65 @@ func TestContain(t *testing.T) {
 	}
 }
 
+func TestToInt(t *testing.T) {
+	testCases := []struct {
+		name string
+		in   interface{}
+		out  int64
+		ok   bool
+	}{
+		{
+			name: "int",
+			in:   int(10),
+			out:  10,
+			ok:   true,
+		},
+		{
+			name: "large uint64",
+			in:   uint64(1 << 63),
+			out:  0,
+			ok:   false,
+		},
+		{
+			name: "json number",
+			in:   json.Number("9007199254740993"),
+			out:  9007199254740993,
+			ok:   true,
+		},
+		{
+			name: "json number float",
+			in:   json.Number("10.5"),
+			out:  0,
+			ok:   false,
+		},
+		{
+			name: "string",
+			in:   "9007199254740993",
+			out:  9007199254740993,
+			ok:   true,
+		},
+		{
+			name: "float",
+			in:   float64(10),
+			out:  0,
+			ok:   false,
+		},
+	}
+
+	for _, tt := range testCases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			out, ok := toInt(tt.in)
+			if ok != tt.ok {
+				t.Fatalf("Expected %v, got %v", tt.ok, ok)
+			}
+			if out != tt.out {
+				t.Fatalf("Expected %d, got %d", tt.out, out)
+			}
+		})
+	}
+}
+
 func TestToFloat(t *testing.T) {
 	testCases := []struct {
 		name string
@@ -274,6 +1403,12 @@ func TestToFloat(t *testing.T) {
 			out:  10,
 			ok:   true,
 		},
+		{
+			name: "json number",
+			in:   json.Number("10.5"),
+			out:  10.5,
+			ok:   true,
+		},
 		{
 			name: "invalid string",
 			in:   "hello",
@@ -34,17 +34,57 @@ func main() {
 		log.Fatalf("Failed to init consumer: %v", err)
 	}
 
+	// Init payload decoder
+	dec, err := NewDecoder(conf)
+	if err != nil {
+		log.Fatalf("Failed to init decoder: %v", err)
+	}
+
 	// Init messages filter
-	f := NewFieldFilter(conf.Filter)
+	ff, err := NewFieldFilter(conf.Filter)
+	if err != nil {
+		log.Fatalf("Failed to init filter: %v", err)
+	}
+	f := MultiFilter{ff}
+	if conf.FilterExpr != "" {
+		ef, err := NewExprFilter(conf.FilterExpr)
+		if err != nil {
+			log.Fatalf("Failed to init filter expression: %v", err)
+		}
+		f = append(f, ef)
+	}
+
+	// JSON payloads are checked by the fields filter before decoding,
+	// so dropped messages are never decoded. Malformed payloads are not
+	// always detected this way, so it's only done when invalid messages
+	// are skipped anyway
+	var pf RawFilter
+	if len(conf.Filter) > 0 &&
+		(conf.PayloadFormat == "" || conf.PayloadFormat == FormatJSON) &&
+		(conf.Invalid.Policy == "" || conf.Invalid.Policy == InvalidSkip) {
+		pf = ff
+	}
 
 	// Init storage
 	var s Storage
-	if conf.File != "" {
-		log.Infof("Saving messages to %s", conf.File)
+	if conf.File.Path != "" {
+		log.Infof("Saving messages to %s", conf.File.Path)
 		s, err = NewFileSystemStorage(conf.File)
 		if err != nil {
 			log.Fatalf("Failed to init file storage: %v", err)
 		}
+	} else if conf.CSV.Path != "" {
+		log.Infof("Saving messages to %s", conf.CSV.Path)
+		s, err = NewCSVStorage(conf.CSV)
+		if err != nil {
+			log.Fatalf("Failed to init csv storage: %v", err)
+		}
+	} else if conf.Parquet.Path != "" {
+		log.Infof("Saving messages to %s", conf.Parquet.Path)
+		s, err = NewParquetStorage(conf.Parquet)
+		if err != nil {
+			log.Fatalf("Failed to init parquet storage: %v", err)
+		}
 	} else {
 		log.Infof("Saving messages to %s", conf.Mongo.Addr)
 		s, err = NewMongoStorage(conf.Mongo)
@@ -53,8 +93,26 @@ func main() {
 		}
 	}
 
+	// Init dead letter for invalid messages
+	var dl *DeadLetter
+	if conf.Invalid.Policy == InvalidDeadLetter {
+		log.Infof("Saving invalid messages to %s", conf.Invalid.DeadLetter)
+		dl, err = NewDeadLetter(conf.Invalid.DeadLetter)
+		if err != nil {
+			log.Fatalf("Failed to init dead letter: %v", err)
+		}
+	}
+
 	// Init pipeline
-	dmp := NewDumper(c, f, s, conf.Logs.Period)
+	dmp := NewDumper(c, f, s, DumperConf{
+		Decoder:    dec,
+		Prefilter:  pf,
+		Workers:    conf.Workers,
+		LogPeriod:  conf.Logs.Period,
+		Limits:     conf.Limits,
+		Invalid:    conf.Invalid.Policy,
+		DeadLetter: dl,
+	})
 
 	// Listen for SIGTERM
 	ctx, cancel := context.WithCancel(context.Background())
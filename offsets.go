@@ -0,0 +1,423 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	kafka "github.com/segmentio/kafka-go"
+	log "github.com/sirupsen/logrus"
+)
+
+// topicPartition identifies a partition of a topic.
+type topicPartition struct {
+	topic     string
+	partition int
+}
+
+func (tp topicPartition) String() string {
+	return fmt.Sprintf("%s/%d", tp.topic, tp.partition)
+}
+
+func partitionOf(p kafka.Partition) topicPartition {
+	return topicPartition{topic: p.Topic, partition: p.ID}
+}
+
+// partitionsTopics gets a sorted list of unique topics of the partitions.
+func partitionsTopics(parts []kafka.Partition) []string {
+	seen := map[string]bool{}
+	var topics []string
+	for _, p := range parts {
+		if !seen[p.Topic] {
+			seen[p.Topic] = true
+			topics = append(topics, p.Topic)
+		}
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+// endDelay is a delay after the end time, before end offsets are read,
+// for messages produced right before the end time to be appended.
+const endDelay = 5 * time.Second
+
+// Limits of fetch requests that look for the last messages of partitions.
+const (
+	probeBytes = 1 << 20
+	probeWait  = time.Second
+)
+
+// bounds tracks partitions that have reached the end time of a bounded dump.
+// End offsets are read once the end time has passed, until then messages
+// are only checked by their timestamps.
+type bounds struct {
+	cl    *cluster
+	parts []kafka.Partition
+	until time.Time
+	ends  map[topicPartition]int64 // offsets after the last messages to read
+	next  map[topicPartition]int64 // offsets of next messages to read
+	done  map[topicPartition]bool
+	total int
+}
+
+// newBounds creates bounds for all partitions. Start offsets are optional
+// and only used to detect partitions with nothing to read.
+func newBounds(
+	cl *cluster,
+	parts []kafka.Partition,
+	until time.Time,
+	start map[topicPartition]int64,
+) *bounds {
+	next := make(map[topicPartition]int64, len(start))
+	for tp, offset := range start {
+		next[tp] = offset
+	}
+	return &bounds{
+		cl:    cl,
+		parts: parts,
+		until: until,
+		next:  next,
+		done:  map[topicPartition]bool{},
+		total: len(parts),
+	}
+}
+
+// resolve reads end offsets of all partitions.
+func (b *bounds) resolve(ctx context.Context) error {
+	// Kafka timestamps have millisecond precision, so the first offset
+	// of the next millisecond is the first message after the end time
+	ends, err := readOffsets(ctx, b.cl, b.parts, b.until.Add(time.Millisecond))
+	if err != nil {
+		return err
+	}
+	firsts, err := readFirstOffsets(ctx, b.cl, b.parts)
+	if err != nil {
+		return err
+	}
+	lasts, err := readLastOffsets(ctx, b.cl, b.parts)
+	if err != nil {
+		return err
+	}
+	// Records right before the end may be never read by readers, e.g.
+	// transaction markers, so partitions end after their last messages
+	ends, err = readPartitionOffsets(ctx, b.cl, b.parts, func(c *kafka.Conn, p kafka.Partition) (int64, error) {
+		tp := partitionOf(p)
+		end := ends[tp]
+		if end < 0 {
+			end = lasts[tp]
+		}
+		return readDataEnd(firsts[tp], end, fetchOffsets(c))
+	})
+	if err != nil {
+		return err
+	}
+	b.setEnds(ends, firsts, lasts)
+	return nil
+}
+
+// readDataEnd gets the offset after the last message before the end
+// offset, or the first offset when there are no messages. Messages are
+// looked for backwards from the end in growing windows. Fetch reads
+// offsets of messages starting from the offset, and returns the offset
+// to continue from.
+func readDataEnd(first, end int64, fetch func(int64) ([]int64, int64, error)) (int64, error) {
+	for window := int64(1); ; window *= 2 {
+		from := end - window
+		if from < first {
+			from = first
+		}
+		last := int64(-1)
+		for offset := from; offset < end; {
+			offsets, next, err := fetch(offset)
+			if err != nil {
+				return 0, err
+			}
+			for _, o := range offsets {
+				if o < end {
+					last = o
+				}
+			}
+			if next <= offset {
+				break
+			}
+			offset = next
+		}
+		if last >= 0 {
+			return last + 1, nil
+		}
+		if from == first {
+			return first, nil
+		}
+	}
+}
+
+// fetchOffsets makes a function that reads offsets of messages
+// of the connection's partition.
+func fetchOffsets(c *kafka.Conn) func(int64) ([]int64, int64, error) {
+	return func(from int64) ([]int64, int64, error) {
+		if _, err := c.Seek(from, kafka.SeekAbsolute); err != nil {
+			return nil, 0, fmt.Errorf("seek offset %d: %v", from, err)
+		}
+		batch := c.ReadBatchWith(kafka.ReadBatchConfig{MaxBytes: probeBytes, MaxWait: probeWait})
+		var offsets []int64
+		for {
+			msg, err := batch.ReadMessage()
+			if err != nil {
+				break
+			}
+			offsets = append(offsets, msg.Offset)
+		}
+		next := batch.Offset()
+		if err := batch.Close(); err != nil && !errors.Is(err, kafka.RequestTimedOut) {
+			return nil, 0, fmt.Errorf("fetch messages: %v", err)
+		}
+		return offsets, next, nil
+	}
+}
+
+// setEnds sets end offsets, and marks partitions with nothing to read as
+// finished. Partitions without messages after the end time have no end
+// offset (-1), they end at their last offset.
+func (b *bounds) setEnds(ends, firsts, lasts map[topicPartition]int64) {
+	b.ends = make(map[topicPartition]int64, len(ends))
+	for tp, end := range ends {
+		if end < 0 {
+			end = lasts[tp]
+		}
+		b.ends[tp] = end
+		if end <= firsts[tp] {
+			b.done[tp] = true
+		}
+		if next, ok := b.next[tp]; ok && next >= end {
+			b.done[tp] = true
+		}
+	}
+}
+
+// check tells whether the message is within the bounds, and marks
+// its partition as finished when the end is reached.
+func (b *bounds) check(msg kafka.Message) bool {
+	tp := topicPartition{topic: msg.Topic, partition: msg.Partition}
+	end, ok := b.ends[tp]
+	if msg.Time.After(b.until) || (ok && msg.Offset >= end) {
+		b.done[tp] = true
+		return false
+	}
+	b.next[tp] = msg.Offset + 1
+	if ok && msg.Offset >= end-1 {
+		b.done[tp] = true
+	}
+	return true
+}
+
+// finished tells whether all partitions have reached the end.
+func (b *bounds) finished() bool {
+	return len(b.done) == b.total
+}
+
+// resolveOffsets converts the start position to offsets of all partitions.
+// Partitions that are not listed explicitly start from the newest messages.
+// Special positions are resolved to the current oldest or newest offsets,
+// partitions without messages after the start time start from the newest.
+func resolveOffsets(
+	ctx context.Context,
+	cl *cluster,
+	parts []kafka.Partition,
+	offset Offset,
+) (map[topicPartition]int64, error) {
+	if !offset.Time.IsZero() {
+		log.Debugf("Get offsets by timestamp %s", offset.Time)
+		return readPartitionOffsets(ctx, cl, parts, func(c *kafka.Conn, _ kafka.Partition) (int64, error) {
+			n, err := c.ReadOffset(offset.Time)
+			if err != nil || n >= 0 {
+				return n, err
+			}
+			return c.ReadLastOffset()
+		})
+	}
+	defaultPos := offset.Position
+	if defaultPos == 0 {
+		defaultPos = OffsetNewest
+	}
+
+	known := make(map[int]bool, len(parts))
+	for _, p := range parts {
+		known[p.ID] = true
+	}
+	for p := range offset.Partitions {
+		if !known[p] {
+			return nil, fmt.Errorf("partition %d not found", p)
+		}
+	}
+
+	return readPartitionOffsets(ctx, cl, parts, func(c *kafka.Conn, p kafka.Partition) (int64, error) {
+		pos, ok := offset.Partitions[p.ID]
+		if !ok {
+			pos = defaultPos
+		}
+		switch pos {
+		case OffsetNewest:
+			return c.ReadLastOffset()
+		case OffsetOldest:
+			return c.ReadFirstOffset()
+		default:
+			return pos, nil
+		}
+	})
+}
+
+// formatOffsets formats partitions offsets for logging.
+func formatOffsets(offsets map[topicPartition]int64) string {
+	parts := make([]topicPartition, 0, len(offsets))
+	for tp := range offsets {
+		parts = append(parts, tp)
+	}
+	sort.Slice(parts, func(i, j int) bool {
+		if parts[i].topic != parts[j].topic {
+			return parts[i].topic < parts[j].topic
+		}
+		return parts[i].partition < parts[j].partition
+	})
+
+	items := make([]string, len(parts))
+	for i, tp := range parts {
+		items[i] = fmt.Sprintf("%s:%d", tp, offsets[tp])
+	}
+	return strings.Join(items, " ")
+}
+
+// readOffsets gets offsets of the first messages produced at or after
+// the given time for all partitions.
+func readOffsets(
+	ctx context.Context,
+	cl *cluster,
+	parts []kafka.Partition,
+	t time.Time,
+) (map[topicPartition]int64, error) {
+	return readPartitionOffsets(ctx, cl, parts, func(c *kafka.Conn, _ kafka.Partition) (int64, error) {
+		return c.ReadOffset(t)
+	})
+}
+
+// readLastOffsets gets offsets after the newest messages for all partitions.
+func readLastOffsets(ctx context.Context, cl *cluster, parts []kafka.Partition) (map[topicPartition]int64, error) {
+	return readPartitionOffsets(ctx, cl, parts, func(c *kafka.Conn, _ kafka.Partition) (int64, error) {
+		return c.ReadLastOffset()
+	})
+}
+
+// readFirstOffsets gets offsets of the oldest messages for all partitions.
+func readFirstOffsets(ctx context.Context, cl *cluster, parts []kafka.Partition) (map[topicPartition]int64, error) {
+	return readPartitionOffsets(ctx, cl, parts, func(c *kafka.Conn, _ kafka.Partition) (int64, error) {
+		return c.ReadFirstOffset()
+	})
+}
+
+func readPartitionOffsets(
+	ctx context.Context,
+	cl *cluster,
+	parts []kafka.Partition,
+	read func(c *kafka.Conn, p kafka.Partition) (int64, error),
+) (map[topicPartition]int64, error) {
+	offsets := make(map[topicPartition]int64, len(parts))
+	for _, p := range parts {
+		c, err := cl.dialLeader(ctx, p)
+		if err != nil {
+			return nil, fmt.Errorf("create connection to %s: %v", partitionOf(p), err)
+		}
+		offset, err := read(c, p)
+		c.Close() // nolint: errcheck,gosec
+		if err != nil {
+			return nil, fmt.Errorf("read offset of %s: %v", partitionOf(p), err)
+		}
+		offsets[partitionOf(p)] = offset
+	}
+	return offsets, nil
+}
+
+// readCommittedOffsets gets offsets committed to the consumer group for all
+// partitions. Partitions without committed offsets start from the given
+// position, the newest messages by default.
+func readCommittedOffsets(
+	ctx context.Context,
+	cl *cluster,
+	gid string,
+	parts []kafka.Partition,
+	pos int64,
+) (map[topicPartition]int64, error) {
+	req := &kafka.OffsetFetchRequest{GroupID: gid, Topics: map[string][]int{}}
+	for _, p := range parts {
+		req.Topics[p.Topic] = append(req.Topics[p.Topic], p.ID)
+	}
+	client := &kafka.Client{
+		Addr:      kafka.TCP(cl.brokers...),
+		Timeout:   cl.dialer.Timeout,
+		Transport: cl.transport(),
+	}
+	resp, err := client.OffsetFetch(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("fetch committed offsets: %v", err)
+	}
+	if resp.Error != nil {
+		return nil, fmt.Errorf("fetch committed offsets: %v", resp.Error)
+	}
+	committed := map[topicPartition]int64{}
+	for topic, offsets := range resp.Topics {
+		for _, p := range offsets {
+			if p.Error != nil {
+				return nil, fmt.Errorf("fetch committed offset of %s/%d: %v", topic, p.Partition, p.Error)
+			}
+			committed[topicPartition{topic: topic, partition: p.Partition}] = p.CommittedOffset
+		}
+	}
+
+	return readPartitionOffsets(ctx, cl, parts, func(c *kafka.Conn, p kafka.Partition) (int64, error) {
+		if offset, ok := committed[partitionOf(p)]; ok && offset >= 0 {
+			return offset, nil
+		}
+		if pos == OffsetOldest {
+			return c.ReadFirstOffset()
+		}
+		return c.ReadLastOffset()
+	})
+}
+
+func setOffset(ctx context.Context, cl *cluster, gid string, offsets map[topicPartition]int64) error {
+	commits := map[string]map[int]int64{}
+	for tp, offset := range offsets {
+		if commits[tp.topic] == nil {
+			commits[tp.topic] = map[int]int64{}
+		}
+		commits[tp.topic][tp.partition] = offset
+	}
+	topics := make([]string, 0, len(commits))
+	for t := range commits {
+		topics = append(topics, t)
+	}
+	sort.Strings(topics)
+
+	log.Debugf("Set offsets (%d partitions) for %s", len(offsets), gid)
+	group, err := kafka.NewConsumerGroup(kafka.ConsumerGroupConfig{
+		Brokers:   cl.brokers,
+		Topics:    topics,
+		ID:        gid,
+		Transport: cl.transport(),
+	})
+	if err != nil {
+		return fmt.Errorf("create consumer group: %v", err)
+	}
+	defer group.Close() // nolint: errcheck
+
+	gen, err := group.Next(ctx)
+	if err != nil {
+		return fmt.Errorf("get next generation: %v", err)
+	}
+	err = gen.CommitOffsets(commits)
+	if err != nil {
+		return fmt.Errorf("commit offsets: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	kafka "github.com/segmentio/kafka-go"
+)
+
+func TestBounds(t *testing.T) {
+	until := time.Date(2024, 5, 1, 15, 0, 0, 0, time.UTC)
+	before := until.Add(-time.Minute)
+	after := until.Add(time.Minute)
+
+	b := &bounds{
+		until: until,
+		ends:  map[topicPartition]int64{{"orders", 0}: 10},
+		next:  map[topicPartition]int64{},
+		done:  map[topicPartition]bool{},
+		total: 4,
+	}
+
+	steps := []struct {
+		msg      kafka.Message
+		ok       bool
+		finished bool
+	}{
+		{
+			msg:      kafka.Message{Topic: "orders", Partition: 0, Offset: 5, Time: before},
+			ok:       true,
+			finished: false,
+		},
+		{
+			msg:      kafka.Message{Topic: "orders", Partition: 1, Offset: 100, Time: before},
+			ok:       true,
+			finished: false,
+		},
+		{
+			// Last message before the end offset
+			msg:      kafka.Message{Topic: "orders", Partition: 0, Offset: 9, Time: before},
+			ok:       true,
+			finished: false,
+		},
+		{
+			msg:      kafka.Message{Topic: "orders", Partition: 1, Offset: 101, Time: after},
+			ok:       false,
+			finished: false,
+		},
+		{
+			msg:      kafka.Message{Topic: "orders", Partition: 2, Offset: 0, Time: after},
+			ok:       false,
+			finished: false,
+		},
+		{
+			// Same partition number, another topic
+			msg:      kafka.Message{Topic: "payments", Partition: 0, Offset: 50, Time: after},
+			ok:       false,
+			finished: true,
+		},
+	}
+
+	for i, s := range steps {
+		if ok := b.check(s.msg); ok != s.ok {
+			t.Fatalf("Step %d: expected %v, got %v", i, s.ok, ok)
+		}
+		if finished := b.finished(); finished != s.finished {
+			t.Fatalf("Step %d: expected finished %v, got %v", i, s.finished, finished)
+		}
+	}
+}
+
+func TestBoundsSetEnds(t *testing.T) {
+	tp := topicPartition{"orders", 0}
+
+	testCases := []struct {
+		name  string
+		end   int64
+		first int64
+		last  int64
+		start map[topicPartition]int64
+		want  int64
+		done  bool
+	}{
+		{
+			name:  "messages after end time",
+			end:   10,
+			first: 0,
+			last:  20,
+			want:  10,
+			done:  false,
+		},
+		{
+			name:  "no messages after end time",
+			end:   -1,
+			first: 0,
+			last:  20,
+			want:  20,
+			done:  false,
+		},
+		{
+			name:  "no messages after end time and nothing to read",
+			end:   -1,
+			first: 0,
+			last:  20,
+			start: map[topicPartition]int64{tp: 20},
+			want:  20,
+			done:  true,
+		},
+		{
+			name:  "empty partition",
+			end:   -1,
+			first: 5,
+			last:  5,
+			want:  5,
+			done:  true,
+		},
+		{
+			name:  "all messages after end time",
+			end:   5,
+			first: 5,
+			last:  20,
+			want:  5,
+			done:  true,
+		},
+		{
+			name:  "start after end",
+			end:   10,
+			first: 0,
+			last:  20,
+			start: map[topicPartition]int64{tp: 15},
+			want:  10,
+			done:  true,
+		},
+	}
+
+	for _, tt := range testCases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			b := newBounds(nil, []kafka.Partition{{Topic: "orders", ID: 0}}, time.Now(), tt.start)
+			b.setEnds(
+				map[topicPartition]int64{tp: tt.end},
+				map[topicPartition]int64{tp: tt.first},
+				map[topicPartition]int64{tp: tt.last},
+			)
+			if b.ends[tp] != tt.want {
+				t.Fatalf("Expected end %d, got %d", tt.want, b.ends[tp])
+			}
+			if b.finished() != tt.done {
+				t.Fatalf("Expected finished %v, got %v", tt.done, b.finished())
+			}
+		})
+	}
+}
+
+func TestBounds_FutureEnd(t *testing.T) {
+	until := time.Now().Add(time.Minute)
+	live := topicPartition{"orders", 0}
+	idle := topicPartition{"orders", 1}
+
+	b := newBounds(nil, []kafka.Partition{
+		{Topic: "orders", ID: 0},
+		{Topic: "orders", ID: 1},
+	}, until, map[topicPartition]int64{live: 10, idle: 20})
+
+	// End offsets are unknown until the end time has passed
+	msg := kafka.Message{Topic: "orders", Partition: 0, Offset: 10, Time: time.Now()}
+	if !b.check(msg) {
+		t.Fatalf("Expected message within bounds")
+	}
+	if b.finished() {
+		t.Fatalf("Expected bounds not finished")
+	}
+
+	// No messages after the end time in both partitions, the idle one
+	// has been read to the end
+	b.setEnds(
+		map[topicPartition]int64{live: -1, idle: -1},
+		map[topicPartition]int64{live: 0, idle: 0},
+		map[topicPartition]int64{live: 12, idle: 20},
+	)
+	if !b.done[idle] || b.done[live] {
+		t.Fatalf("Expected only idle partition finished, got %v", b.done)
+	}
+
+	msg = kafka.Message{Topic: "orders", Partition: 0, Offset: 11, Time: time.Now()}
+	if !b.check(msg) {
+		t.Fatalf("Expected message within bounds")
+	}
+	if !b.finished() {
+		t.Fatalf("Expected bounds finished")
+	}
+}
+
+func TestReadDataEnd(t *testing.T) {
+	testCases := []struct {
+		name    string
+		first   int64
+		end     int64
+		markers []int64
+		want    int64
+	}{
+		{
+			name: "last message",
+			end:  10,
+			want: 10,
+		},
+		{
+			name:    "transaction marker",
+			end:     10,
+			markers: []int64{9},
+			want:    9,
+		},
+		{
+			name:    "many markers",
+			end:     10,
+			markers: []int64{3, 4, 5, 6, 7, 8, 9},
+			want:    3,
+		},
+		{
+			name:    "only markers",
+			first:   5,
+			end:     10,
+			markers: []int64{5, 6, 7, 8, 9},
+			want:    5,
+		},
+		{
+			name:  "empty partition",
+			first: 10,
+			end:   10,
+			want:  10,
+		},
+	}
+
+	for _, tt := range testCases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			markers := map[int64]bool{}
+			for _, o := range tt.markers {
+				markers[o] = true
+			}
+			// Batches of 3 records, new messages are appended after the end
+			fetch := func(from int64) ([]int64, int64, error) {
+				var offsets []int64
+				for o := from; o < from+3; o++ {
+					if !markers[o] {
+						offsets = append(offsets, o)
+					}
+				}
+				return offsets, from + 3, nil
+			}
+			end, err := readDataEnd(tt.first, tt.end, fetch)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if end != tt.want {
+				t.Fatalf("Expected %d, got %d", tt.want, end)
+			}
+		})
+	}
+}
+
+func TestFormatOffsets(t *testing.T) {
+	out := formatOffsets(map[topicPartition]int64{
+		{"payments", 0}: 40,
+		{"orders", 1}:   20,
+		{"orders", 0}:   10,
+	})
+	if out != "orders/0:10 orders/1:20 payments/0:40" {
+		t.Fatalf("Unexpected result: %s", out)
+	}
+}
+
+func TestPartitionsTopics(t *testing.T) {
+	topics := partitionsTopics([]kafka.Partition{
+		{Topic: "payments", ID: 0},
+		{Topic: "orders", ID: 0},
+		{Topic: "orders", ID: 1},
+		{Topic: "payments", ID: 1},
+	})
+	if strings.Join(topics, ",") != "orders,payments" {
+		t.Fatalf("Unexpected result: %v", topics)
+	}
+}
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+	log "github.com/sirupsen/logrus"
+)
+
+// Types of parquet columns.
+const (
+	ParquetString = "string"
+	ParquetInt    = "int"
+	ParquetFloat  = "float"
+	ParquetBool   = "bool"
+	ParquetTime   = "time"
+	ParquetJSON   = "json"
+)
+
+const (
+	// parquetExtra is a catch-all column for fields that don't fit
+	// the schema.
+	parquetExtra = "_extra"
+
+	defaultInferRows    = 1000
+	defaultRowGroupSize = 100000
+)
+
+// parquetKafkaColumns are columns of kafka message attributes, that are
+// added to inferred schemas.
+var parquetKafkaColumns = []ParquetColumn{
+	{Name: "_time", Field: "$time", Type: ParquetTime},
+	{Name: "_topic", Field: "$topic", Type: ParquetString},
+	{Name: "_partition", Field: "$partition", Type: ParquetInt},
+	{Name: "_offset", Field: "$offset", Type: ParquetInt},
+	{Name: "_key", Field: "$key", Type: ParquetString},
+}
+
+// ParquetStorage is a storage that saves messages to a parquet file.
+// The schema is either set in config, or inferred from the first messages,
+// that are kept in memory until then. Payload fields that don't fit
+// the schema are saved as a JSON object to the catch-all column. Saved
+// messages are only durable after the file is closed, so the storage
+// cannot be used with consumer groups.
+type ParquetStorage struct {
+	file         *os.File
+	writer       *parquet.Writer
+	columns      []parquetColumn
+	extra        int
+	rowGroupSize int64
+
+	inferRows int
+	pending   []Message
+}
+
+// parquetColumn is a column of the schema with its field extractor
+// and index in the parquet schema.
+type parquetColumn struct {
+	ParquetColumn
+	field field
+	index int
+}
+
+// NewParquetStorage creates new parquet storage. When the schema is set
+// in config the file is created right away, otherwise it's created once
+// the schema is inferred.
+func NewParquetStorage(conf ParquetConf) (*ParquetStorage, error) {
+	if conf.InferRows <= 0 {
+		conf.InferRows = defaultInferRows
+	}
+	if conf.RowGroupSize <= 0 {
+		conf.RowGroupSize = defaultRowGroupSize
+	}
+
+	f, err := os.OpenFile(conf.Path, os.O_RDWR|os.O_TRUNC|os.O_CREATE, 0o600) // nolint: gosec
+	if err != nil {
+		return nil, fmt.Errorf("open file %s: %v", conf.Path, err)
+	}
+	s := &ParquetStorage{
+		file:         f,
+		rowGroupSize: conf.RowGroupSize,
+		inferRows:    conf.InferRows,
+	}
+	if len(conf.Columns) > 0 {
+		if err := s.init(conf.Columns); err != nil {
+			f.Close() // nolint: errcheck,gosec
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Save saves a message to the file. Until the schema is inferred messages
+// are kept in memory.
+func (s *ParquetStorage) Save(msg Message) error {
+	if s.writer != nil {
+		return s.write(msg)
+	}
+	s.pending = append(s.pending, msg)
+	if len(s.pending) < s.inferRows {
+		return nil
+	}
+	return s.flushPending()
+}
+
+// Flush commits written row groups to disk. Messages that are kept
+// in memory are not written, and the file cannot be read until
+// it's closed.
+func (s *ParquetStorage) Flush() error {
+	if err := s.file.Sync(); err != nil {
+		return fmt.Errorf("sync file: %v", err)
+	}
+	return nil
+}
+
+// Close infers the schema when it's not done yet, writes the last row
+// group and the footer of the file.
+func (s *ParquetStorage) Close() {
+	if s.writer == nil && len(s.pending) > 0 {
+		if err := s.flushPending(); err != nil {
+			log.Errorf("Failed to write messages: %v", err)
+		}
+	}
+	if s.writer != nil {
+		if err := s.writer.Close(); err != nil {
+			log.Errorf("Failed to finalize parquet file: %v", err)
+		}
+	}
+	s.file.Close() // nolint: errcheck,gosec
+}
+
+// flushPending infers the schema from the pending messages and writes them.
+func (s *ParquetStorage) flushPending() error {
+	if err := s.init(inferParquetColumns(s.pending)); err != nil {
+		return fmt.Errorf("init schema: %v", err)
+	}
+	for _, msg := range s.pending {
+		if err := s.write(msg); err != nil {
+			return err
+		}
+	}
+	s.pending = nil
+	return nil
+}
+
+// init creates the schema and the writer.
+func (s *ParquetStorage) init(columns []ParquetColumn) error {
+	group := parquet.Group{}
+	s.columns = make([]parquetColumn, len(columns))
+	for i, col := range columns {
+		if col.Name == "" || col.Name == parquetExtra {
+			return fmt.Errorf("invalid column name %q", col.Name)
+		}
+		if _, ok := group[col.Name]; ok {
+			return fmt.Errorf("duplicate column %s", col.Name)
+		}
+		if col.Field == "" {
+			col.Field = col.Name
+		}
+		node, err := parquetNode(col.Type)
+		if err != nil {
+			return fmt.Errorf("column %s: %v", col.Name, err)
+		}
+		fields, err := parseColumns([]string{col.Field})
+		if err != nil {
+			return fmt.Errorf("column %s: %v", col.Name, err)
+		}
+		group[col.Name] = parquet.Optional(node)
+		s.columns[i] = parquetColumn{ParquetColumn: col, field: fields[0]}
+	}
+	group[parquetExtra] = parquet.Optional(parquet.JSON())
+
+	// Columns of a group are sorted by name, so indexes are
+	// found by names
+	schema := parquet.NewSchema("message", group)
+	indexes := map[string]int{}
+	for i, f := range schema.Fields() {
+		indexes[f.Name()] = i
+	}
+	for i := range s.columns {
+		s.columns[i].index = indexes[s.columns[i].Name]
+	}
+	s.extra = indexes[parquetExtra]
+
+	s.writer = parquet.NewWriter(s.file, schema,
+		parquet.MaxRowsPerRowGroup(s.rowGroupSize),
+		parquet.Compression(&parquet.Snappy),
+	)
+	return nil
+}
+
+// write writes a message as a row.
+func (s *ParquetStorage) write(msg Message) error {
+	row := make(parquet.Row, len(s.columns)+1)
+	extra := map[string]interface{}{}
+	for k, v := range msg.data {
+		extra[k] = v
+	}
+
+	for _, col := range s.columns {
+		row[col.index] = parquet.NullValue().Level(0, 0, col.index)
+		if !strings.HasPrefix(col.Field, "$") {
+			extra = removeField(extra, col.Field)
+		}
+		val, ok := col.field(msg)
+		if !ok || val == nil {
+			continue
+		}
+		v, ok := parquetValue(col.Type, val)
+		if !ok {
+			extra[col.Field] = val
+			continue
+		}
+		row[col.index] = v.Level(0, 1, col.index)
+	}
+
+	row[s.extra] = parquet.NullValue().Level(0, 0, s.extra)
+	if len(extra) > 0 {
+		b, err := json.Marshal(extra)
+		if err != nil {
+			return fmt.Errorf("marshall extra fields: %v", err)
+		}
+		row[s.extra] = parquet.ByteArrayValue(b).Level(0, 1, s.extra)
+	}
+
+	if _, err := s.writer.WriteRows([]parquet.Row{row}); err != nil {
+		return fmt.Errorf("write data to file: %v", err)
+	}
+	return nil
+}
+
+// inferParquetColumns makes a schema of kafka attributes and top-level
+// payload fields. Fields with values of different types are saved as JSON.
+func inferParquetColumns(messages []Message) []ParquetColumn {
+	types := map[string]string{}
+	for _, msg := range messages {
+		for k, v := range msg.data {
+			typ := parquetType(v)
+			if typ == "" {
+				continue
+			}
+			prev, ok := types[k]
+			switch {
+			case !ok || prev == typ:
+				types[k] = typ
+			case prev == ParquetInt && typ == ParquetFloat,
+				prev == ParquetFloat && typ == ParquetInt:
+				types[k] = ParquetFloat
+			default:
+				types[k] = ParquetJSON
+			}
+		}
+	}
+
+	names := make([]string, 0, len(types))
+	for name := range types {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	columns := append([]ParquetColumn{}, parquetKafkaColumns...)
+	for _, name := range names {
+		if strings.HasPrefix(name, "_") || strings.HasPrefix(name, "$") {
+			// Saved to the catch-all column
+			continue
+		}
+		columns = append(columns, ParquetColumn{Name: name, Type: types[name]})
+	}
+	return columns
+}
+
+// parquetType gets a column type for a value. Returns empty string
+// for null values.
+func parquetType(val interface{}) string {
+	switch v := val.(type) {
+	case nil:
+		return ""
+	case string:
+		return ParquetString
+	case bool:
+		return ParquetBool
+	case json.Number:
+		if _, err := v.Int64(); err == nil {
+			return ParquetInt
+		}
+		return ParquetFloat
+	case int, int64:
+		return ParquetInt
+	case float64:
+		return ParquetFloat
+	default:
+		return ParquetJSON
+	}
+}
+
+// parquetNode creates a schema node of the column type.
+func parquetNode(typ string) (parquet.Node, error) {
+	switch typ {
+	case ParquetString:
+		return parquet.String(), nil
+	case ParquetInt:
+		return parquet.Int(64), nil
+	case ParquetFloat:
+		return parquet.Leaf(parquet.DoubleType), nil
+	case ParquetBool:
+		return parquet.Leaf(parquet.BooleanType), nil
+	case ParquetTime:
+		return parquet.Timestamp(parquet.Millisecond), nil
+	case ParquetJSON:
+		return parquet.JSON(), nil
+	default:
+		return nil, fmt.Errorf("unknown type %q", typ)
+	}
+}
+
+// parquetValue converts a value to the column type. Returns false when
+// the value doesn't fit the column.
+func parquetValue(typ string, val interface{}) (parquet.Value, bool) {
+	switch typ {
+	case ParquetString:
+		if s, ok := val.(string); ok {
+			return parquet.ByteArrayValue([]byte(s)), true
+		}
+	case ParquetInt:
+		if parquetType(val) == ParquetInt {
+			if i, ok := toInt(val); ok {
+				return parquet.Int64Value(i), true
+			}
+		}
+	case ParquetFloat:
+		if t := parquetType(val); t == ParquetInt || t == ParquetFloat {
+			if f, ok := toFloat(val); ok {
+				return parquet.DoubleValue(f), true
+			}
+		}
+	case ParquetBool:
+		if b, ok := val.(bool); ok {
+			return parquet.BooleanValue(b), true
+		}
+	case ParquetTime:
+		switch v := val.(type) {
+		case time.Time:
+			return parquet.Int64Value(v.UnixMilli()), true
+		case string:
+			if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+				return parquet.Int64Value(t.UnixMilli()), true
+			}
+		}
+	case ParquetJSON:
+		if b, err := json.Marshal(val); err == nil {
+			return parquet.ByteArrayValue(b), true
+		}
+	}
+	return parquet.Value{}, false
+}
+
+// removeField removes the value of the field path from the data, so that
+// other fields of nested objects are kept. Objects and lists on the path
+// are copied, so the values of the message are not changed. Nested
+// objects left empty are removed too, list elements are kept, since
+// removing them would shift indexes of the others.
+func removeField(data map[string]interface{}, fieldPath string) map[string]interface{} {
+	if _, ok := data[fieldPath]; ok {
+		delete(data, fieldPath)
+		return data
+	}
+	var steps []interface{}
+	for _, part := range strings.Split(fieldPath, ".") {
+		key, indexes, ok := splitIndexes(part)
+		if !ok {
+			return data
+		}
+		if key != "" {
+			steps = append(steps, key)
+		}
+		for _, i := range indexes {
+			steps = append(steps, i)
+		}
+	}
+	out, _ := withoutPath(data, steps)
+	return out.(map[string]interface{})
+}
+
+// withoutPath makes a copy of the value without the path of object keys
+// and list indexes. Returns false when an object is left empty.
+func withoutPath(val interface{}, steps []interface{}) (interface{}, bool) {
+	switch step := steps[0].(type) {
+	case string:
+		obj, ok := val.(map[string]interface{})
+		if !ok {
+			return val, true
+		}
+		v, ok := obj[step]
+		if !ok {
+			return val, true
+		}
+		out := make(map[string]interface{}, len(obj))
+		for k, v := range obj {
+			out[k] = v
+		}
+		if len(steps) == 1 {
+			delete(out, step)
+		} else if v, ok := withoutPath(v, steps[1:]); ok {
+			out[step] = v
+		} else {
+			delete(out, step)
+		}
+		return out, len(out) > 0
+	case int:
+		list, ok := val.([]interface{})
+		if !ok || step >= len(list) || len(steps) == 1 {
+			return val, true
+		}
+		out := append([]interface{}{}, list...)
+		out[step], _ = withoutPath(list[step], steps[1:])
+		return out, true
+	}
+	return val, true
+}
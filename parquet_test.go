@@ -0,0 +1,198 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+func TestParquetStorage(t *testing.T) {
+	payloads := []string{
+		`{"id": 1, "amount": 10, "status": "paid", "user": {"id": 42, "name": "alice"}}`,
+		`{"id": 2, "amount": 10.5, "status": 3, "_ts": 1}`,
+		`{"id": 3, "amount": null, "user": {"id": 7}}`,
+	}
+
+	testCases := []struct {
+		name string
+		conf ParquetConf
+		rows []map[string]interface{}
+	}{
+		{
+			name: "inferred schema",
+			conf: ParquetConf{InferRows: 2},
+			rows: []map[string]interface{}{
+				{
+					"_time": time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC), "_topic": "orders",
+					"_partition": int64(0), "_offset": int64(0), "_key": nil,
+					"id": int64(1), "amount": 10.0, "status": `"paid"`, "user": `{"id":42,"name":"alice"}`,
+					"_extra": nil,
+				},
+				{
+					"_time": time.Date(2024, 5, 1, 10, 0, 1, 0, time.UTC), "_topic": "orders",
+					"_partition": int64(0), "_offset": int64(1), "_key": nil,
+					"id": int64(2), "amount": 10.5, "status": `3`, "user": nil,
+					"_extra": `{"_ts":1}`,
+				},
+				{
+					"_time": time.Date(2024, 5, 1, 10, 0, 2, 0, time.UTC), "_topic": "orders",
+					"_partition": int64(0), "_offset": int64(2), "_key": nil,
+					"id": int64(3), "amount": nil, "status": nil, "user": `{"id":7}`,
+					"_extra": nil,
+				},
+			},
+		},
+		{
+			name: "explicit schema",
+			conf: ParquetConf{Columns: []ParquetColumn{
+				{Name: "offset", Field: "$offset", Type: ParquetInt},
+				{Name: "amount", Type: ParquetInt},
+				{Name: "status", Type: ParquetString},
+				{Name: "user_id", Field: "user.id", Type: ParquetInt},
+			}},
+			rows: []map[string]interface{}{
+				// Only the extracted field is removed from the nested object
+				{
+					"offset": int64(0), "amount": int64(10), "status": "paid", "user_id": int64(42),
+					"_extra": `{"id":1,"user":{"name":"alice"}}`,
+				},
+				{
+					"offset": int64(1), "amount": nil, "status": nil, "user_id": nil,
+					"_extra": `{"_ts":1,"amount":10.5,"id":2,"status":3}`,
+				},
+				{"offset": int64(2), "amount": nil, "status": nil, "user_id": int64(7), "_extra": `{"id":3}`},
+			},
+		},
+	}
+
+	for _, tt := range testCases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "messages.parquet")
+			tt.conf.Path = file
+			s, err := NewParquetStorage(tt.conf)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			for i, p := range payloads {
+				msg := Message{
+					time:   time.Date(2024, 5, 1, 10, 0, i, 0, time.UTC),
+					topic:  "orders",
+					offset: int64(i),
+					raw:    []byte(p),
+				}
+				if err := msg.decode(&JSONDecoder{}); err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				if err := s.Save(msg); err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+			}
+			s.Close()
+
+			rows := readParquet(t, file)
+			if !reflect.DeepEqual(rows, tt.rows) {
+				t.Fatalf("Expected %v, got %v", tt.rows, rows)
+			}
+		})
+	}
+}
+
+func TestParquetStorage_RowGroups(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "messages.parquet")
+	s, err := NewParquetStorage(ParquetConf{
+		Path:         file,
+		Columns:      []ParquetColumn{{Name: "id", Type: ParquetInt}},
+		RowGroupSize: 2,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, msg := range testMessages(5, nil) {
+		if err := msg.decode(&JSONDecoder{}); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if err := s.Save(msg); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	s.Close()
+
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer f.Close() // nolint: errcheck
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	pf, err := parquet.OpenFile(f, info.Size())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if n := len(pf.RowGroups()); n != 3 {
+		t.Fatalf("Expected 3 row groups, got %d", n)
+	}
+	if n := pf.NumRows(); n != 5 {
+		t.Fatalf("Expected 5 rows, got %d", n)
+	}
+}
+
+// readParquet reads all rows of the file. Values of JSON columns are
+// returned as strings.
+func readParquet(t *testing.T, file string) []map[string]interface{} {
+	t.Helper()
+
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer f.Close() // nolint: errcheck
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	pf, err := parquet.OpenFile(f, info.Size())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	fields := pf.Schema().Fields()
+	var rows []map[string]interface{}
+	r := parquet.NewReader(pf)
+	buf := make([]parquet.Row, 1)
+	for {
+		n, err := r.ReadRows(buf)
+		if n == 0 {
+			break
+		}
+		row := map[string]interface{}{}
+		for _, v := range buf[0] {
+			f := fields[v.Column()]
+			switch {
+			case v.IsNull():
+				row[f.Name()] = nil
+			case f.Type().LogicalType() != nil && f.Type().LogicalType().Timestamp != nil:
+				row[f.Name()] = time.UnixMilli(v.Int64()).UTC()
+			case v.Kind() == parquet.ByteArray:
+				row[f.Name()] = string(v.ByteArray())
+			case v.Kind() == parquet.Int64:
+				row[f.Name()] = v.Int64()
+			case v.Kind() == parquet.Double:
+				row[f.Name()] = v.Double()
+			default:
+				row[f.Name()] = v.Boolean()
+			}
+		}
+		rows = append(rows, row)
+		if err != nil {
+			break
+		}
+	}
+	return rows
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression algorithms of output files.
+const (
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+// Placeholders of file name templates.
+const (
+	placeholderTopic = "{topic}"
+	placeholderDate  = "{date}"
+	placeholderTime  = "{time}"
+	placeholderSeq   = "{seq}"
+)
+
+// rotatingFile is an output file that is switched to a new one when it
+// reaches one of the limits. Names of the files are made from a template
+// with {date}, {time} and {seq} placeholders. Size of the file is counted
+// on disk, i.e. after compression, including the data that is buffered
+// and not written to the file yet.
+type rotatingFile struct {
+	template string
+	conf     FileConf
+
+	file    *os.File
+	buf     *bufio.Writer
+	out     io.Writer
+	enc     compressor
+	disk    *countingWriter
+	name    string
+	seq     int
+	records int
+	opened  time.Time
+}
+
+// compressor is a compressing writer.
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// countingWriter counts bytes written to the underlying writer.
+type countingWriter struct {
+	w     io.Writer
+	bytes int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.bytes += int64(n)
+	return n, err
+}
+
+// newRotatingFile opens the first file of the template.
+func newRotatingFile(template string, conf FileConf) (*rotatingFile, error) {
+	f := &rotatingFile{template: template, conf: conf}
+	if err := f.open(f.firstSeq()); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Write writes a record made of the parts to the file, rotating it before
+// writing when one of the limits is reached. Parts of the record are never
+// split between files.
+func (f *rotatingFile) Write(parts ...[]byte) error {
+	var size int
+	for _, p := range parts {
+		size += len(p)
+	}
+	if f.full(size) {
+		if err := f.rotate(); err != nil {
+			return fmt.Errorf("rotate file: %v", err)
+		}
+	}
+	f.records++
+	for _, p := range parts {
+		if _, err := f.out.Write(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Flush commits the current file to disk. Data buffered by the compressor
+// is written first, so the file can be decompressed up to this point.
+func (f *rotatingFile) Flush() error {
+	if f.enc != nil {
+		if err := f.enc.Flush(); err != nil {
+			return fmt.Errorf("flush compression of %s: %v", f.name, err)
+		}
+	}
+	if err := f.buf.Flush(); err != nil {
+		return fmt.Errorf("write file %s: %v", f.name, err)
+	}
+	if err := f.file.Sync(); err != nil {
+		return fmt.Errorf("sync file %s: %v", f.name, err)
+	}
+	return nil
+}
+
+// Close properly closes the current file. Compressed stream is finalized
+// and buffered data is written before closing.
+func (f *rotatingFile) Close() error {
+	if f.enc != nil {
+		if err := f.enc.Close(); err != nil {
+			f.file.Close() // nolint: errcheck,gosec
+			return fmt.Errorf("finalize compression of %s: %v", f.name, err)
+		}
+	}
+	if err := f.buf.Flush(); err != nil {
+		f.file.Close() // nolint: errcheck,gosec
+		return fmt.Errorf("write file %s: %v", f.name, err)
+	}
+	return f.file.Close()
+}
+
+// full tells whether the file should be rotated before writing a record
+// of the given size. Empty files are never rotated. Compressed size of
+// the record is unknown, so compressed files are rotated when they have
+// reached the limit.
+func (f *rotatingFile) full(size int) bool {
+	if f.records == 0 && f.disk.bytes == 0 {
+		return false
+	}
+	if f.conf.MaxRecords > 0 && f.records >= f.conf.MaxRecords {
+		return true
+	}
+	if f.enc != nil {
+		size = 0
+	}
+	if f.conf.MaxBytes > 0 && f.disk.bytes+int64(size) > f.conf.MaxBytes {
+		return true
+	}
+	if f.conf.Interval > 0 && time.Since(f.opened) >= f.conf.Interval {
+		return true
+	}
+	return false
+}
+
+// rotate closes the current file, opens the next one and removes
+// the oldest files above the limit. Existing files are skipped.
+func (f *rotatingFile) rotate() error {
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("close file %s: %v", f.name, err)
+	}
+	seq := f.seq + 1
+	for exists(f.format(seq, time.Now())) {
+		seq++
+	}
+	if err := f.open(seq); err != nil {
+		return err
+	}
+	return f.cleanup()
+}
+
+// open opens a file with the sequence number. Existing files are either
+// appended or truncated.
+func (f *rotatingFile) open(seq int) error {
+	now := time.Now()
+	name := f.format(seq, now)
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if f.conf.Append {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+	file, err := os.OpenFile(name, flags, 0o600) // nolint: gosec
+	if err != nil {
+		return fmt.Errorf("open file %s: %v", name, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close() // nolint: errcheck,gosec
+		return fmt.Errorf("get file %s info: %v", name, err)
+	}
+
+	buf := bufio.NewWriter(file)
+	disk := &countingWriter{w: buf, bytes: info.Size()}
+	enc, err := newCompressor(disk, f.conf.Compression, f.conf.CompressionLevel)
+	if err != nil {
+		file.Close() // nolint: errcheck,gosec
+		return err
+	}
+
+	f.file = file
+	f.buf = buf
+	f.out = disk
+	f.enc = enc
+	if enc != nil {
+		f.out = enc
+	}
+	f.disk = disk
+	f.name = name
+	f.seq = seq
+	f.records = 0
+	f.opened = now
+	return nil
+}
+
+// firstSeq finds the sequence number to start from. Existing files are
+// never overwritten: the last of them is continued in append mode,
+// otherwise a new file is started after them.
+func (f *rotatingFile) firstSeq() int {
+	if !strings.Contains(f.template, placeholderSeq) {
+		return 1
+	}
+	seq := 1
+	for exists(f.format(seq, time.Now())) {
+		seq++
+	}
+	if f.conf.Append && seq > 1 {
+		seq--
+	}
+	return seq
+}
+
+// cleanup removes the oldest files made from the template, so that
+// no more than max files are retained. Files are ordered by their date,
+// time and sequence number.
+func (f *rotatingFile) cleanup() error {
+	if f.conf.MaxFiles <= 0 {
+		return nil
+	}
+	glob, re := f.patterns()
+	names, err := filepath.Glob(glob)
+	if err != nil {
+		return fmt.Errorf("list files: %v", err)
+	}
+
+	type file struct {
+		name string
+		date string
+		time string
+		seq  int
+	}
+	var files []file
+	for _, name := range names {
+		m := re.FindStringSubmatch(name)
+		if m == nil {
+			continue
+		}
+		file := file{name: name}
+		for i, group := range re.SubexpNames() {
+			switch group {
+			case "date":
+				file.date = m[i]
+			case "time":
+				file.time = m[i]
+			case "seq":
+				file.seq, _ = strconv.Atoi(m[i]) // nolint: errcheck
+			}
+		}
+		files = append(files, file)
+	}
+	if len(files) <= f.conf.MaxFiles {
+		return nil
+	}
+
+	// Formats of date and time are ordered lexicographically
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].date != files[j].date {
+			return files[i].date < files[j].date
+		}
+		if files[i].time != files[j].time {
+			return files[i].time < files[j].time
+		}
+		return files[i].seq < files[j].seq
+	})
+	for _, file := range files[:len(files)-f.conf.MaxFiles] {
+		if file.name == f.name {
+			continue
+		}
+		if err := os.Remove(file.name); err != nil {
+			return fmt.Errorf("remove file %s: %v", file.name, err)
+		}
+	}
+	return nil
+}
+
+// patterns makes a glob pattern to list the files made from the template,
+// and a regular expression to match their names exactly. Placeholders
+// are captured by groups named after them.
+func (f *rotatingFile) patterns() (string, *regexp.Regexp) {
+	placeholders := map[string]string{
+		placeholderDate: `\d{4}-\d{2}-\d{2}`,
+		placeholderTime: `\d{8}-\d{6}`,
+		placeholderSeq:  `\d+`,
+	}
+	var glob, re strings.Builder
+	seen := map[string]bool{}
+	for rest := f.template; rest != ""; {
+		i := strings.IndexByte(rest, '{')
+		if i < 0 {
+			i = len(rest)
+		}
+		var name string
+		for p := range placeholders {
+			if strings.HasPrefix(rest[i:], p) {
+				name = p
+			}
+		}
+		if name == "" && i < len(rest) {
+			i++ // literal brace
+		}
+		glob.WriteString(globEscaper.Replace(rest[:i]))
+		re.WriteString(regexp.QuoteMeta(rest[:i]))
+		rest = rest[i:]
+		if name == "" {
+			continue
+		}
+		glob.WriteString("*")
+		if seen[name] {
+			re.WriteString("(?:" + placeholders[name] + ")")
+		} else {
+			re.WriteString("(?P<" + strings.Trim(name, "{}") + ">" + placeholders[name] + ")")
+		}
+		seen[name] = true
+		rest = rest[len(name):]
+	}
+	return glob.String(), regexp.MustCompile("^" + re.String() + "$")
+}
+
+// globEscaper escapes special characters of glob patterns.
+var globEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	`*`, `\*`,
+	`?`, `\?`,
+	`[`, `\[`,
+)
+
+// format makes a file name from the template.
+func (f *rotatingFile) format(seq int, t time.Time) string {
+	return strings.NewReplacer(
+		placeholderDate, t.Format("2006-01-02"),
+		placeholderTime, t.Format("20060102-150405"),
+		placeholderSeq, strconv.Itoa(seq),
+	).Replace(f.template)
+}
+
+// newCompressor creates a compressing writer, or returns nil when
+// the compression is not set. Zero level means the default level.
+func newCompressor(w io.Writer, compression string, level int) (compressor, error) {
+	switch compression {
+	case "":
+		return nil, nil
+	case CompressionGzip:
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		enc, err := gzip.NewWriterLevel(w, level)
+		if err != nil {
+			return nil, fmt.Errorf("create gzip writer: %v", err)
+		}
+		return enc, nil
+	case CompressionZstd:
+		opts := []zstd.EOption{}
+		if level != 0 {
+			opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+		}
+		enc, err := zstd.NewWriter(w, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("create zstd writer: %v", err)
+		}
+		return enc, nil
+	default:
+		return nil, fmt.Errorf("unknown compression: %s", compression)
+	}
+}
+
+// exists tells whether the file exists.
+func exists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestRotatingFile(t *testing.T) {
+	testCases := []struct {
+		name    string
+		conf    FileConf
+		records int
+		files   map[string]string
+	}{
+		{
+			name:    "no limits",
+			records: 3,
+			files:   map[string]string{"dump-1.txt": "0\n1\n2\n"},
+		},
+		{
+			name:    "max records",
+			conf:    FileConf{MaxRecords: 2},
+			records: 5,
+			files: map[string]string{
+				"dump-1.txt": "0\n1\n",
+				"dump-2.txt": "2\n3\n",
+				"dump-3.txt": "4\n",
+			},
+		},
+		{
+			name:    "max bytes",
+			conf:    FileConf{MaxBytes: 5},
+			records: 5,
+			files: map[string]string{
+				"dump-1.txt": "0\n1\n",
+				"dump-2.txt": "2\n3\n",
+				"dump-3.txt": "4\n",
+			},
+		},
+		{
+			name:    "max files",
+			conf:    FileConf{MaxRecords: 1, MaxFiles: 2},
+			records: 5,
+			files: map[string]string{
+				"dump-4.txt": "3\n",
+				"dump-5.txt": "4\n",
+			},
+		},
+	}
+
+	for _, tt := range testCases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			f, err := newRotatingFile(filepath.Join(dir, "dump-{seq}.txt"), tt.conf)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			for i := 0; i < tt.records; i++ {
+				// Record and separator are never split between files
+				if err := f.Write([]byte{byte('0' + i)}, newline); err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+			}
+			if err := f.Close(); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			files := readDir(t, dir)
+			if !reflect.DeepEqual(files, tt.files) {
+				t.Fatalf("Expected %v, got %v", tt.files, files)
+			}
+		})
+	}
+}
+
+func TestRotatingFile_Flush(t *testing.T) {
+	dir := t.TempDir()
+	f, err := newRotatingFile(filepath.Join(dir, "dump.txt"), FileConf{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer f.Close() // nolint: errcheck
+
+	if err := f.Write([]byte("a"), newline); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// Records are buffered until flushed
+	if files := readDir(t, dir); files["dump.txt"] != "" {
+		t.Fatalf("Expected empty file, got %q", files["dump.txt"])
+	}
+	if err := f.Flush(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if files := readDir(t, dir); files["dump.txt"] != "a\n" {
+		t.Fatalf("Expected %q, got %q", "a\n", files["dump.txt"])
+	}
+}
+
+func TestRotatingFile_Restart(t *testing.T) {
+	testCases := []struct {
+		name  string
+		conf  FileConf
+		files map[string]string
+	}{
+		{
+			name: "new file",
+			files: map[string]string{
+				"dump-1.txt": "a\n",
+				"dump-2.txt": "b\n",
+				"dump-3.txt": "c\n",
+			},
+		},
+		{
+			name: "append",
+			conf: FileConf{Append: true},
+			files: map[string]string{
+				"dump-1.txt": "a\n",
+				"dump-2.txt": "b\nc\n",
+			},
+		},
+	}
+
+	for _, tt := range testCases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, data := range map[string]string{"dump-1.txt": "a\n", "dump-2.txt": "b\n"} {
+				if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0o600); err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+			}
+
+			f, err := newRotatingFile(filepath.Join(dir, "dump-{seq}.txt"), tt.conf)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if err := f.Write([]byte("c\n")); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if err := f.Close(); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			files := readDir(t, dir)
+			if !reflect.DeepEqual(files, tt.files) {
+				t.Fatalf("Expected %v, got %v", tt.files, files)
+			}
+		})
+	}
+}
+
+func TestRotatingFile_Cleanup(t *testing.T) {
+	testCases := []struct {
+		name     string
+		template string
+		files    []string
+		want     []string
+	}{
+		{
+			name:     "by seq",
+			template: "dump-orders-{seq}.txt",
+			files: []string{
+				"dump-orders-1.txt",
+				"dump-orders-2.txt",
+				"dump-orders-3.txt",
+				"dump-orders-4.txt",
+				"dump-orders-5.txt",
+				"dump-orders-6.txt",
+				"dump-orders-7.txt",
+				"dump-orders-8.txt",
+				"dump-orders-9.txt",
+				"dump-orders-10.txt",
+				"dump-orders-eu-1.txt",
+				"dump-orders-backup.txt",
+				"dump-orders-1.txt.bak",
+				"notes.txt",
+			},
+			want: []string{
+				"dump-orders-1.txt.bak",
+				"dump-orders-10.txt",
+				"dump-orders-11.txt",
+				"dump-orders-backup.txt",
+				"dump-orders-eu-1.txt",
+				"notes.txt",
+			},
+		},
+		{
+			name:     "by date and seq",
+			template: "dump-[x]-{date}-{seq}.txt",
+			files: []string{
+				"dump-[x]-2024-05-02-1.txt",
+				"dump-[x]-2024-05-01-1.txt",
+				"dump-[x]-2024-05-01-2.txt",
+				"dump-x-2024-05-01-1.txt",
+			},
+			want: []string{
+				"dump-[x]-2024-05-02-1.txt",
+				"dump-[x]-" + time.Now().Format("2006-01-02") + "-1.txt",
+				"dump-x-2024-05-01-1.txt",
+			},
+		},
+	}
+
+	for _, tt := range testCases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			// Older files are modified later, so the order doesn't
+			// depend on modification times
+			mod := time.Now()
+			for _, name := range tt.files {
+				path := filepath.Join(dir, name)
+				if err := os.WriteFile(path, nil, 0o600); err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				mod = mod.Add(-time.Hour)
+				if err := os.Chtimes(path, mod, mod); err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+			}
+
+			f, err := newRotatingFile(filepath.Join(dir, tt.template), FileConf{MaxFiles: 2})
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if err := f.cleanup(); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if err := f.Close(); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			files := readDir(t, dir)
+			names := make([]string, 0, len(files))
+			for name := range files {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			if !reflect.DeepEqual(names, tt.want) {
+				t.Fatalf("Expected %v, got %v", tt.want, names)
+			}
+		})
+	}
+}
+
+func TestRotatingFile_Compression(t *testing.T) {
+	testCases := []struct {
+		name        string
+		compression string
+		level       int
+		decompress  func(io.Reader) (io.Reader, error)
+	}{
+		{
+			name:        "gzip",
+			compression: CompressionGzip,
+			decompress: func(r io.Reader) (io.Reader, error) {
+				return gzip.NewReader(r)
+			},
+		},
+		{
+			name:        "gzip with level",
+			compression: CompressionGzip,
+			level:       9,
+			decompress: func(r io.Reader) (io.Reader, error) {
+				return gzip.NewReader(r)
+			},
+		},
+		{
+			name:        "zstd",
+			compression: CompressionZstd,
+			level:       3,
+			decompress: func(r io.Reader) (io.Reader, error) {
+				return zstd.NewReader(r)
+			},
+		},
+	}
+
+	for _, tt := range testCases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			f, err := newRotatingFile(filepath.Join(dir, "dump-{seq}.gz"), FileConf{
+				MaxRecords:       2,
+				Compression:      tt.compression,
+				CompressionLevel: tt.level,
+			})
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			for i := 0; i < 3; i++ {
+				if err := f.Write([]byte{byte('0' + i), '\n'}); err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+			}
+			if err := f.Close(); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			want := map[string]string{
+				"dump-1.gz": "0\n1\n",
+				"dump-2.gz": "2\n",
+			}
+			for name, content := range want {
+				file, err := os.Open(filepath.Join(dir, name))
+				if err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				r, err := tt.decompress(file)
+				if err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				data, err := io.ReadAll(r)
+				file.Close() // nolint: errcheck,gosec
+				if err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				if string(data) != content {
+					t.Fatalf("Expected %q, got %q", content, string(data))
+				}
+			}
+		})
+	}
+}
+
+func TestRotatingFile_AppendCompressed(t *testing.T) {
+	dir := t.TempDir()
+	template := filepath.Join(dir, "dump-{seq}.gz")
+
+	f, err := newRotatingFile(template, FileConf{Compression: CompressionGzip})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := f.Write([]byte("0\n")); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	info, err := os.Stat(filepath.Join(dir, "dump-1.gz"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Size is counted on disk, so the file is full as soon as
+	// the appended data is flushed
+	f, err = newRotatingFile(template, FileConf{
+		Compression: CompressionGzip,
+		Append:      true,
+		MaxBytes:    info.Size() + 1,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if f.disk.bytes != info.Size() {
+		t.Fatalf("Expected %d bytes, got %d", info.Size(), f.disk.bytes)
+	}
+	for i := 1; i < 3; i++ {
+		if err := f.Write([]byte{byte('0' + i), '\n'}); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if err := f.Flush(); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	want := map[string]string{
+		"dump-1.gz": "0\n1\n",
+		"dump-2.gz": "2\n",
+	}
+	for name, content := range want {
+		file, err := os.Open(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		r, err := gzip.NewReader(file)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		data, err := io.ReadAll(r)
+		file.Close() // nolint: errcheck,gosec
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if string(data) != content {
+			t.Fatalf("Expected %q, got %q", content, string(data))
+		}
+	}
+}
+
+// readDir reads all files of the directory.
+func readDir(t *testing.T, dir string) map[string]string {
+	t.Helper()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	files := make(map[string]string, len(entries))
+	for _, e := range entries {
+		data, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		files[e.Name()] = string(data)
+	}
+	return files
+}
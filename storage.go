@@ -4,50 +4,144 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"os"
+	"strings"
 	"time"
 
+	log "github.com/sirupsen/logrus"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.mongodb.org/mongo-driver/mongo/readpref"
 )
 
-// Storage describes a storage for messages.
+// Storage describes a storage for messages. Saved messages may be buffered,
+// Flush makes them durable before their offsets are committed.
 type Storage interface {
 	Save(Message) error
+	Flush() error
 	Close()
 }
 
-// FileSystemStorage is a storage that saves messages to a file.
+// File formats.
+const (
+	FileFormatPretty = "pretty"
+	FileFormatJSONL  = "jsonl"
+)
+
+// newline separates messages in files.
+var newline = []byte("\n")
+
+// FileSystemStorage is a storage that saves messages to a file. Files are
+// rotated by limits from config, and when the path has {topic} placeholder,
+// messages of each topic are saved to separate files.
 type FileSystemStorage struct {
-	file *os.File
+	conf  FileConf
+	files map[string]*rotatingFile
+}
+
+// fileRecord is an envelope of a message with its kafka attributes.
+type fileRecord struct {
+	Time      time.Time              `json:"time"`
+	Topic     string                 `json:"topic"`
+	Partition int                    `json:"partition"`
+	Offset    int64                  `json:"offset"`
+	Value     map[string]interface{} `json:"value"`
 }
 
 // NewFileSystemStorage creates new filesystem storage.
-func NewFileSystemStorage(file string) (*FileSystemStorage, error) {
-	f, err := os.OpenFile(file, os.O_RDWR|os.O_TRUNC|os.O_CREATE, 0o600) // nolint: gosec
-	if err != nil {
-		return nil, fmt.Errorf("open file %s: %v", file, err)
+func NewFileSystemStorage(conf FileConf) (*FileSystemStorage, error) {
+	if conf.Format == "" {
+		conf.Format = FileFormatPretty
+	}
+	s := &FileSystemStorage{
+		conf:  conf,
+		files: map[string]*rotatingFile{},
+	}
+	// Check the file on start, when it doesn't depend on messages
+	if !strings.Contains(conf.Path, placeholderTopic) {
+		if _, err := s.file(Message{}); err != nil {
+			return nil, err
+		}
 	}
-	return &FileSystemStorage{file: f}, nil
+	return s, nil
 }
 
-// Save formats a message as an indented json and saves it to the file.
+// Save formats a message and saves it to the file. Messages are saved
+// either as indented json, or as compact json, one per line. In raw mode
+// the original payload is saved as is.
 func (s *FileSystemStorage) Save(msg Message) error {
-	data, err := json.MarshalIndent(msg.data, "", "    ")
+	data, err := s.marshal(msg)
 	if err != nil {
 		return fmt.Errorf("marshall message: %v", err)
 	}
-	_, err = s.file.Write(append(data, []byte("\n")...))
+	f, err := s.file(msg)
+	if err != nil {
+		return err
+	}
+	// Payload is written as is, without copying it to add the separator
+	err = f.Write(data, newline)
 	if err != nil {
 		return fmt.Errorf("write data to file: %v", err)
 	}
 	return nil
 }
 
-// Close properly closes the file.
+// file gets the file for the message, opening it on first use.
+func (s *FileSystemStorage) file(msg Message) (*rotatingFile, error) {
+	var topic string
+	if strings.Contains(s.conf.Path, placeholderTopic) {
+		topic = msg.topic
+	}
+	if f, ok := s.files[topic]; ok {
+		return f, nil
+	}
+	template := strings.ReplaceAll(s.conf.Path, placeholderTopic, topic)
+	f, err := newRotatingFile(template, s.conf)
+	if err != nil {
+		return nil, err
+	}
+	s.files[topic] = f
+	return f, nil
+}
+
+func (s *FileSystemStorage) marshal(msg Message) ([]byte, error) {
+	if s.conf.Raw {
+		return msg.raw, nil
+	}
+
+	var v interface{} = msg.data
+	if s.conf.Envelope {
+		v = fileRecord{
+			Time:      msg.time,
+			Topic:     msg.topic,
+			Partition: msg.partition,
+			Offset:    msg.offset,
+			Value:     msg.data,
+		}
+	}
+	if s.conf.Format == FileFormatJSONL {
+		return json.Marshal(v)
+	}
+	return json.MarshalIndent(v, "", "    ")
+}
+
+// Flush commits saved messages of all files to disk.
+func (s *FileSystemStorage) Flush() error {
+	for _, f := range s.files {
+		if err := f.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close properly closes the files. Failed close may leave a compressed
+// file truncated, so it is logged.
 func (s *FileSystemStorage) Close() {
-	s.file.Close() // nolint: errcheck,gosec
+	for _, f := range s.files {
+		if err := f.Close(); err != nil {
+			log.Errorf("Failed to close file: %v", err)
+		}
+	}
 }
 
 // MongoStorage is a storage that saves messages to mongodb.
@@ -99,6 +193,11 @@ func (s *MongoStorage) Save(msg Message) error {
 	return nil
 }
 
+// Flush does nothing, messages are written to mongodb when they are saved.
+func (s *MongoStorage) Flush() error {
+	return nil
+}
+
 // Close properly closes mongodb connection.
 func (s *MongoStorage) Close() {
 	s.client.Disconnect(context.Background()) // nolint: errcheck,gosec
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFileSystemStorage(t *testing.T) {
+	raw := []byte(`{"b": 1.50, "a": [1, 2]}`)
+
+	testCases := []struct {
+		name string
+		conf FileConf
+		out  string
+	}{
+		{
+			name: "pretty",
+			out:  "{\n    \"a\": [\n        1,\n        2\n    ],\n    \"b\": 1.50\n}\n",
+		},
+		{
+			name: "jsonl",
+			conf: FileConf{Format: FileFormatJSONL},
+			out:  "{\"a\":[1,2],\"b\":1.50}\n",
+		},
+		{
+			name: "jsonl with envelope",
+			conf: FileConf{Format: FileFormatJSONL, Envelope: true},
+			out: `{"time":"2024-05-01T10:00:00Z","topic":"orders","partition":3,` +
+				`"offset":42,"value":{"a":[1,2],"b":1.50}}` + "\n",
+		},
+		{
+			name: "raw",
+			conf: FileConf{Raw: true},
+			out:  "{\"b\": 1.50, \"a\": [1, 2]}\n",
+		},
+	}
+
+	for _, tt := range testCases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "messages.txt")
+			tt.conf.Path = file
+			s, err := NewFileSystemStorage(tt.conf)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			msg := Message{
+				time:      time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC),
+				topic:     "orders",
+				partition: 3,
+				offset:    42,
+				raw:       raw,
+			}
+			if err := msg.decode(&JSONDecoder{}); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if err := s.Save(msg); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			s.Close()
+
+			data, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if string(data) != tt.out {
+				t.Fatalf("Expected %q, got %q", tt.out, string(data))
+			}
+		})
+	}
+}
+
+func TestFileSystemStorage_Topics(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewFileSystemStorage(FileConf{
+		Path:   filepath.Join(dir, "dump-{topic}.jsonl"),
+		Format: FileFormatJSONL,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, topic := range []string{"orders", "payments", "orders"} {
+		msg := Message{topic: topic, data: map[string]interface{}{"topic": topic}}
+		if err := s.Save(msg); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	s.Close()
+
+	want := map[string]string{
+		"dump-orders.jsonl":   "{\"topic\":\"orders\"}\n{\"topic\":\"orders\"}\n",
+		"dump-payments.jsonl": "{\"topic\":\"payments\"}\n",
+	}
+	files := readDir(t, dir)
+	if !reflect.DeepEqual(files, want) {
+		t.Fatalf("Expected %v, got %v", want, files)
+	}
+}